@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/supremind/csi-didiyun-ebs/pkg/didiyun/ebs"
@@ -11,13 +14,26 @@ import (
 )
 
 var (
-	endpoint = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
-	nodeID   = flag.String("nodeid", "", "node id")
-	nodeIP   = flag.String("nodeip", "", "node ip")
-	regionID = flag.String("regionid", "", "region id")
-	zoneID   = flag.String("zoneid", "", "zone id")
-	token    = flag.String("token", "", "ebs api token")
-	timeout  = flag.Uint("timeout", 30, "ebs rpc timeout, in second")
+	configFile = flag.String("config", "", "path of the yaml config file, settings are overridden by flags set explicitly")
+	endpoint   = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
+	httpAddr   = flag.String("http-address", ":9898", "address to serve metrics and health checks, disabled if empty")
+	tracing    = flag.String("tracing-endpoint", "", "otlp grpc endpoint to export traces, eg: otel-collector:4317, tracing is disabled if empty")
+	interval   = flag.Duration("health-check-interval", time.Minute, "interval of checking didiyun accessibility for health probes")
+	grace      = flag.Duration("shutdown-grace-period", 25*time.Second, "time to wait for in-flight requests to finish on SIGTERM or SIGINT")
+	nodeID     = flag.String("nodeid", "", "node id")
+	nodeIP     = flag.String("nodeip", "", "node ip")
+	regionID   = flag.String("regionid", "", "region id")
+	zoneID     = flag.String("zoneid", "", "zone id")
+	token      = flag.String("token", "", "ebs api token, visible in process lists, prefer --token-file")
+	tokenFile  = flag.String("token-file", "", "file of the ebs api token, the token is rotated when the file changes")
+	timeout    = flag.Uint("timeout", 30, "ebs rpc timeout, in second")
+	retries    = flag.Int("retries", 5, "max retries of failed ebs rpc, negative to disable retrying")
+	backoff    = flag.Duration("retry-backoff", time.Second, "initial backoff before retrying failed ebs rpc")
+	qps        = flag.Float64("qps", 10, "max queries per second of all ebs rpc, not limited if not positive")
+	burst      = flag.Int("burst", 20, "max burst of all ebs rpc")
+	opLimits   = flag.String("operation-rate-limits", "", "comma separated rate limits of ebs rpc operations, as qps:burst, eg: get=10:20,attach=1:2")
+	quotas     = flag.String("capacity-quotas", "", "comma separated capacity quotas in GiB of zones and types, eg: gz01/SSD=1024,gz02/HE=2048")
+	namePrefix = flag.String("volume-name-prefix", "pvc", "--volume-name-prefix of csi-provisioner, only volumes named with it are listed")
 )
 
 func main() {
@@ -25,26 +41,146 @@ func main() {
 	flag.Parse()
 	syncKlog()
 
-	cfg := &ebs.DriverConfig{
-		NodeID:   *nodeID,
-		NodeIP:   *nodeIP,
-		RegionID: *regionID,
-		ZoneID:   *zoneID,
-		Token:    *token,
-		Endpoint: *endpoint,
-		Timeout:  time.Duration(*timeout) * time.Second,
+	capacityQuotas, e := parseQuotas(*quotas)
+	if e != nil {
+		fmt.Printf("Invalid capacity quotas: %s", e)
+		os.Exit(1)
+	}
+
+	operationLimits, e := parseRateLimits(*opLimits)
+	if e != nil {
+		fmt.Printf("Invalid operation rate limits: %s", e)
+		os.Exit(1)
+	}
+
+	// flags override fields of the config
+	overrides := map[string]func(cfg *ebs.DriverConfig){
+		"nodeid":                func(cfg *ebs.DriverConfig) { cfg.NodeID = *nodeID },
+		"nodeip":                func(cfg *ebs.DriverConfig) { cfg.NodeIP = *nodeIP },
+		"regionid":              func(cfg *ebs.DriverConfig) { cfg.RegionID = *regionID },
+		"zoneid":                func(cfg *ebs.DriverConfig) { cfg.ZoneID = *zoneID },
+		"token":                 func(cfg *ebs.DriverConfig) { cfg.Token = *token },
+		"token-file":            func(cfg *ebs.DriverConfig) { cfg.TokenFile = *tokenFile },
+		"endpoint":              func(cfg *ebs.DriverConfig) { cfg.Endpoint = *endpoint },
+		"http-address":          func(cfg *ebs.DriverConfig) { cfg.HTTPAddress = *httpAddr },
+		"health-check-interval": func(cfg *ebs.DriverConfig) { cfg.HealthCheckInterval = *interval },
+		"tracing-endpoint":      func(cfg *ebs.DriverConfig) { cfg.TracingEndpoint = *tracing },
+		"shutdown-grace-period": func(cfg *ebs.DriverConfig) { cfg.ShutdownGracePeriod = *grace },
+		"timeout":               func(cfg *ebs.DriverConfig) { cfg.Timeout = time.Duration(*timeout) * time.Second },
+		"capacity-quotas":       func(cfg *ebs.DriverConfig) { cfg.CapacityQuotas = capacityQuotas },
+		"volume-name-prefix":    func(cfg *ebs.DriverConfig) { cfg.VolumeNamePrefix = *namePrefix },
+		"retries":               func(cfg *ebs.DriverConfig) { cfg.Retry.MaxRetries = *retries },
+		"retry-backoff":         func(cfg *ebs.DriverConfig) { cfg.Retry.InitialBackoff = *backoff },
+		"qps":                   func(cfg *ebs.DriverConfig) { cfg.RateLimit.Global.QPS = *qps },
+		"burst":                 func(cfg *ebs.DriverConfig) { cfg.RateLimit.Global.Burst = *burst },
+		"operation-rate-limits": func(cfg *ebs.DriverConfig) { cfg.RateLimit.Operations = operationLimits },
+		"v": func(cfg *ebs.DriverConfig) {
+			cfg.LogLevel, _ = strconv.Atoi(flag.Lookup("v").Value.String())
+		},
+	}
+	override := func(cfg *ebs.DriverConfig, f *flag.Flag) {
+		if o, ok := overrides[f.Name]; ok {
+			o(cfg)
+		}
+	}
+
+	load := func() (*ebs.DriverConfig, error) {
+		// defaults of flags, then the config file, then flags set explicitly, then env vars
+		cfg := &ebs.DriverConfig{}
+		flag.VisitAll(func(f *flag.Flag) { override(cfg, f) })
+		if *configFile != "" {
+			if e := ebs.LoadConfigFile(*configFile, cfg); e != nil {
+				return nil, e
+			}
+			flag.Visit(func(f *flag.Flag) { override(cfg, f) })
+		}
+		overrideByEnv(cfg, os.LookupEnv)
+		return cfg, cfg.Validate()
+	}
+
+	cfg, e := load()
+	if e != nil {
+		fmt.Printf("Failed to load config: %s", e)
+		os.Exit(1)
 	}
 	driver, e := ebs.NewDriver(cfg)
 	if e != nil {
 		fmt.Printf("Failed to initialize driver: %s", e)
 		os.Exit(1)
 	}
+	if *configFile != "" {
+		if e := driver.WatchConfig(context.Background(), *configFile, load); e != nil {
+			fmt.Printf("Failed to watch config file: %s", e)
+			os.Exit(1)
+		}
+	}
 	driver.Run()
 }
 
+// overrideByEnv applies environment variables MAX_VOLUMES_PER_NODE and ENABLE_CHECK_DEVICE if they are set by lookup,
+// invalid MAX_VOLUMES_PER_NODE, like the empty one rendered by the chart by default, is logged and ignored
+func overrideByEnv(cfg *ebs.DriverConfig, lookup func(key string) (string, bool)) {
+	if val, ok := lookup("MAX_VOLUMES_PER_NODE"); ok {
+		if n, e := strconv.ParseInt(val, 10, 64); e != nil {
+			klog.V(2).Infof("parse env var MAX_VOLUMES_PER_NODE failed: %v", e)
+		} else if n <= 0 {
+			klog.V(2).Infof("invalid env var MAX_VOLUMES_PER_NODE value: %d", n)
+		} else {
+			cfg.MaxVolumesPerNode = n
+		}
+	}
+	if val, ok := lookup("ENABLE_CHECK_DEVICE"); ok {
+		cfg.CheckDevice = val != "" && val != "0"
+	}
+}
+
+func parseQuotas(s string) (map[string]int64, error) {
+	quotas := make(map[string]int64)
+	for _, q := range strings.Split(s, ",") {
+		if q = strings.TrimSpace(q); q == "" {
+			continue
+		}
+		kv := strings.SplitN(q, "=", 2)
+		if len(kv) != 2 || !strings.Contains(kv[0], "/") {
+			return nil, fmt.Errorf("invalid quota %s", q)
+		}
+		size, e := strconv.ParseInt(kv[1], 10, 64)
+		if e != nil || size < 0 {
+			return nil, fmt.Errorf("invalid quota size %s", q)
+		}
+		quotas[kv[0]] = size
+	}
+	return quotas, nil
+}
+
+func parseRateLimits(s string) (map[string]ebs.RateLimit, error) {
+	limits := make(map[string]ebs.RateLimit)
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %s", l)
+		}
+		qb := strings.SplitN(kv[1], ":", 2)
+		qps, e := strconv.ParseFloat(qb[0], 64)
+		if e != nil {
+			return nil, fmt.Errorf("invalid rate limit qps %s", l)
+		}
+		burst := 1
+		if len(qb) == 2 {
+			if burst, e = strconv.Atoi(qb[1]); e != nil {
+				return nil, fmt.Errorf("invalid rate limit burst %s", l)
+			}
+		}
+		limits[kv[0]] = ebs.RateLimit{QPS: qps, Burst: burst}
+	}
+	return limits, nil
+}
+
 func syncKlog() {
-	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
-	klog.InitFlags(klogFlags)
+	klogFlags := ebs.KlogFlags()
 	// Sync the glog and klog flags.
 	flag.CommandLine.VisitAll(func(f1 *flag.Flag) {
 		f2 := klogFlags.Lookup(f1.Name)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/supremind/csi-didiyun-ebs/pkg/didiyun/ebs"
+)
+
+func TestOverrideByEnv(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		env      map[string]string
+		expected int64
+	}{
+		{name: "unset", env: map[string]string{}, expected: 8},
+		{name: "valid", env: map[string]string{"MAX_VOLUMES_PER_NODE": "16"}, expected: 16},
+		{name: "empty", env: map[string]string{"MAX_VOLUMES_PER_NODE": ""}, expected: 8},
+		{name: "invalid", env: map[string]string{"MAX_VOLUMES_PER_NODE": "many"}, expected: 8},
+		{name: "not positive", env: map[string]string{"MAX_VOLUMES_PER_NODE": "-1"}, expected: 8},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &ebs.DriverConfig{MaxVolumesPerNode: 8}
+			overrideByEnv(cfg, func(key string) (string, bool) {
+				val, ok := c.env[key]
+				return val, ok
+			})
+			assert.Equal(t, c.expected, cfg.MaxVolumesPerNode)
+		})
+	}
+}
+
+func TestOverrideCheckDeviceByEnv(t *testing.T) {
+	cfg := &ebs.DriverConfig{}
+	overrideByEnv(cfg, func(key string) (string, bool) { return "1", key == "ENABLE_CHECK_DEVICE" })
+	assert.True(t, cfg.CheckDevice)
+	overrideByEnv(cfg, func(key string) (string, bool) { return "", key == "ENABLE_CHECK_DEVICE" })
+	assert.False(t, cfg.CheckDevice)
+}
@@ -0,0 +1,207 @@
+package ebs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/didiyun/didiyun-go-sdk/base/v1"
+	sdk "github.com/didiyun/didiyun-go-sdk/client"
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	apiEndpoint     = "open.didiyunapi.com:8080"
+	jobPollInterval = 3 * time.Second
+)
+
+// cloudClient covers didiyun apis used by the driver, but not provided by didiyunClient.EbsClient
+type cloudClient interface {
+	ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error)
+	CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error)
+	CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error)
+	ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error)
+	DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error
+}
+
+type sdkClient struct {
+	conn *grpc.ClientConn
+	ebs  compute.EbsClient
+	snap compute.SnapClient
+	job  compute.CommonClient
+}
+
+var _ cloudClient = (*sdkClient)(nil)
+
+func newCloudClient(token string) (*sdkClient, error) {
+	conn, e := sdk.GetGRPCClient(token, apiEndpoint)
+	if e != nil {
+		return nil, e
+	}
+	return &sdkClient{
+		conn: conn,
+		ebs:  compute.NewEbsClient(conn),
+		snap: compute.NewSnapClient(conn),
+		job:  compute.NewCommonClient(conn),
+	}, nil
+}
+
+func (t *sdkClient) Close() error {
+	return t.conn.Close()
+}
+
+func (t *sdkClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	logger(ctx).V(4).Infof("listing ebs in %s/%s, from %d", regionID, zoneID, start)
+	resp, e := t.ebs.ListEbs(ctx, &compute.ListEbsRequest{
+		Header: &base.Header{RegionId: regionID, ZoneId: zoneID},
+		Start:  start,
+		Limit:  limit,
+	})
+	if e != nil {
+		return nil, fmt.Errorf("list ebs error %w", e)
+	}
+	if resp.Error.Errno != 0 {
+		return nil, fmt.Errorf("list ebs error %s (%d)", resp.Error.Errmsg, resp.Error.Errno)
+	}
+	return resp.GetData(), nil
+}
+
+func (t *sdkClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	logger(ctx).V(4).Infof("creating ebs %s from snapshot %s, type %s, size %d GB", name, snapUUID, typ, sizeGB)
+	resp, e := t.ebs.CreateEbs(ctx, &compute.CreateEbsRequest{
+		Header:   &base.Header{RegionId: regionID, ZoneId: zoneID},
+		Count:    1,
+		Name:     name,
+		Size:     sizeGB,
+		DiskType: typ,
+		SnapUuid: snapUUID,
+	})
+	if e != nil {
+		return "", fmt.Errorf("create ebs error %w", e)
+	}
+	if resp.Error.Errno != 0 {
+		return "", fmt.Errorf("create ebs error %s (%d)", resp.Error.Errmsg, resp.Error.Errno)
+	}
+
+	job, e := t.waitForJob(ctx, resp.Data, regionID)
+	if e != nil {
+		return "", e
+	}
+	if !job.Success {
+		if job.ResourceUuid != "" { // not success, but still got uuid that already created
+			return job.ResourceUuid, nil
+		}
+		return "", fmt.Errorf("failed to create ebs: %s", job.Result)
+	}
+	return job.ResourceUuid, nil
+}
+
+func (t *sdkClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	logger(ctx).V(4).Infof("creating snapshot %s of ebs %s", name, ebsUUID)
+	resp, e := t.snap.CreateSnapshot(ctx, &compute.CreateSnapshotRequest{
+		Header:   &base.Header{RegionId: regionID},
+		EbsUuid:  ebsUUID,
+		SnapName: name,
+	})
+	if e != nil {
+		return "", fmt.Errorf("create snapshot error %w", e)
+	}
+	if resp.Error.Errno != 0 {
+		return "", fmt.Errorf("create snapshot error %s (%d)", resp.Error.Errmsg, resp.Error.Errno)
+	}
+
+	job, e := t.waitForJob(ctx, resp.Data, regionID)
+	if e != nil {
+		return "", e
+	}
+	if !job.Success {
+		if job.ResourceUuid != "" {
+			return job.ResourceUuid, nil
+		}
+		return "", fmt.Errorf("failed to create snapshot: %s", job.Result)
+	}
+	return job.ResourceUuid, nil
+}
+
+func (t *sdkClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	logger(ctx).V(4).Infof("listing snapshots of ebs %q, name %q, from %d", ebsUUID, name, start)
+	resp, e := t.snap.ListSnapshot(ctx, &compute.ListSnapshotRequest{
+		Header:    &base.Header{RegionId: regionID},
+		Start:     start,
+		Limit:     limit,
+		Condition: &compute.ListSnapshotCondition{EbsUuid: ebsUUID, SnapName: name},
+	})
+	if e != nil {
+		return nil, fmt.Errorf("list snapshot error %w", e)
+	}
+	if resp.Error.Errno != 0 {
+		return nil, fmt.Errorf("list snapshot error %s (%d)", resp.Error.Errmsg, resp.Error.Errno)
+	}
+	return resp.GetData(), nil
+}
+
+func (t *sdkClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	logger(ctx).V(4).Infof("deleting snapshot %s", snapUUID)
+	resp, e := t.snap.DeleteSnapshot(ctx, &compute.DeleteSnapshotRequest{
+		Header: &base.Header{RegionId: regionID},
+		Snap:   []*compute.DeleteSnapshotRequest_Input{{SnapUuid: snapUUID}},
+	})
+	if e != nil {
+		return fmt.Errorf("delete snapshot error %w", e)
+	}
+	if resp.Error.Errno != 0 {
+		return fmt.Errorf("delete snapshot error %s (%d)", resp.Error.Errmsg, resp.Error.Errno)
+	}
+
+	job, e := t.waitForJob(ctx, resp.Data, regionID)
+	if e != nil {
+		return e
+	}
+	if !job.Success {
+		return fmt.Errorf("failed to delete snapshot: %s", job.Result)
+	}
+	return nil
+}
+
+// firstJob returns the job of a response, which is expected to be the only one
+func firstJob(data []*base.JobInfo) (*base.JobInfo, error) {
+	if len(data) == 0 {
+		return nil, status.Error(codes.Internal, "empty response")
+	}
+	return data[0], nil
+}
+
+func (t *sdkClient) waitForJob(ctx context.Context, data []*base.JobInfo, regionID string) (*base.JobInfo, error) {
+	info, e := firstJob(data)
+	if e != nil {
+		return nil, e
+	}
+	for {
+		if info.Done {
+			return info, nil
+		}
+
+		logger(ctx).V(5).Infof("wait for job %+v", *info)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+		resp, e := t.job.JobResult(ctx, &compute.JobResultRequest{
+			Header:   &base.Header{RegionId: regionID},
+			JobUuids: []string{info.JobUuid},
+		})
+		if e != nil {
+			return nil, fmt.Errorf("job result error %w", e)
+		}
+		if resp.Error.Errno != 0 {
+			return nil, fmt.Errorf("job result error %s (%d)", resp.Error.Errmsg, resp.Error.Errno)
+		}
+		if info, e = firstJob(resp.Data); e != nil {
+			return nil, e
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package ebs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/didiyun/didiyun-go-sdk/base/v1"
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	"github.com/pborman/uuid"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+)
+
+type mockCloudClient struct {
+	ebs   []*compute.EbsInfo
+	snaps []*compute.SnapInfo
+	// snapshots are created in progress if pending
+	pending bool
+	// snapshots are created failed if failed
+	failed bool
+	// returned by CreateFromSnapshot if not nil
+	createErr error
+	created   int
+}
+
+var _ cloudClient = (*mockCloudClient)(nil)
+
+func newMockCloudClient() *mockCloudClient {
+	return &mockCloudClient{}
+}
+
+func (t *mockCloudClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	var matched []*compute.EbsInfo
+	for _, v := range t.ebs {
+		if regionID != "" && v.GetRegion().GetId() != regionID {
+			continue
+		}
+		if zoneID != "" && v.GetRegion().GetZone().GetId() != zoneID {
+			continue
+		}
+		matched = append(matched, v)
+	}
+	if int(start) >= len(matched) {
+		return nil, nil
+	}
+	end := int(start + limit)
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[start:end], nil
+}
+
+func (t *mockCloudClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	if t.createErr != nil {
+		return "", t.createErr
+	}
+	for _, s := range t.snaps {
+		if s.SnapUuid == snapUUID {
+			id := uuid.NewUUID().String()
+			t.addEbs(id, regionID, zoneID, name, typ, sizeGB)
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("snapshot %s not found", snapUUID)
+}
+
+func (t *mockCloudClient) addEbs(id, regionID, zoneID, name, typ string, sizeGB int64) {
+	t.ebs = append(t.ebs, &compute.EbsInfo{
+		Name:    name,
+		EbsUuid: id,
+		Type:    typ,
+		Size:    sizeGB << 30,
+		Region:  &base.RegionAndZoneInfo{Id: regionID, Zone: &base.ZoneInfo{Id: zoneID}},
+	})
+}
+
+func (t *mockCloudClient) getEbs(id string) *compute.EbsInfo {
+	for _, v := range t.ebs {
+		if v.EbsUuid == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (t *mockCloudClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	for _, s := range t.snaps {
+		if s.Name == name {
+			return "", fmt.Errorf("%s already exist", name)
+		}
+	}
+	id := uuid.NewUUID().String()
+	snap := &compute.SnapInfo{
+		SnapUuid:   id,
+		Name:       name,
+		CreateTime: time.Now().UnixNano() / int64(time.Millisecond),
+		Size:       1 << 30,
+		Ebs:        &compute.EbsInfo{EbsUuid: ebsUUID},
+	}
+	if t.pending {
+		snap.Job = &base.JobInfo{JobUuid: uuid.NewUUID().String()}
+	}
+	if t.failed {
+		snap.Job = &base.JobInfo{JobUuid: uuid.NewUUID().String(), Done: true, Result: "disk error"}
+	}
+	t.snaps = append(t.snaps, snap)
+	t.created++
+	return id, nil
+}
+
+func (t *mockCloudClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	var matched []*compute.SnapInfo
+	for _, s := range t.snaps {
+		if ebsUUID != "" && s.Ebs.EbsUuid != ebsUUID {
+			continue
+		}
+		if name != "" && s.Name != name {
+			continue
+		}
+		matched = append(matched, s)
+	}
+	if int(start) >= len(matched) {
+		return nil, nil
+	}
+	end := int(start + limit)
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[start:end], nil
+}
+
+func (t *mockCloudClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	for i, s := range t.snaps {
+		if s.SnapUuid == snapUUID {
+			t.snaps = append(t.snaps[:i], t.snaps[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not found", snapUUID)
+}
+
+// mockEbsClient shares volumes between the didiyun mock and mockCloudClient,
+// so that volumes created by one client could be found by the other
+type mockEbsClient struct {
+	didiyunClient.EbsClient
+	cloud *mockCloudClient
+}
+
+var _ didiyunClient.EbsClient = (*mockEbsClient)(nil)
+
+func newMockClients() (*mockEbsClient, *mockCloudClient) {
+	c, _ := didiyunClient.NewMock()
+	cloud := newMockCloudClient()
+	return &mockEbsClient{EbsClient: c.Ebs(), cloud: cloud}, cloud
+}
+
+func (t *mockEbsClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	id, e := t.EbsClient.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+	if e != nil {
+		return "", e
+	}
+	t.cloud.addEbs(id, regionID, zoneID, name, typ, sizeGB)
+	return id, nil
+}
+
+func (t *mockEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	if info := t.cloud.getEbs(ebsUUID); info != nil {
+		return info, nil
+	}
+	return t.EbsClient.Get(ctx, ebsUUID)
+}
+
+func (t *mockEbsClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	device, e := t.EbsClient.Attach(ctx, ebsUUID, dc2Name)
+	if e != nil {
+		return "", e
+	}
+	if info := t.cloud.getEbs(ebsUUID); info != nil {
+		info.Dc2 = &compute.Dc2Info{Name: dc2Name}
+		info.DeviceName = device
+	}
+	return device, nil
+}
+
+func (t *mockEbsClient) Detach(ctx context.Context, ebsUUID string) error {
+	if e := t.EbsClient.Detach(ctx, ebsUUID); e != nil {
+		return e
+	}
+	if info := t.cloud.getEbs(ebsUUID); info != nil {
+		info.Dc2 = nil
+		info.DeviceName = ""
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package ebs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/didiyun/didiyun-go-sdk/base/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWaitForJobEmptyResponse(t *testing.T) {
+	cli := &sdkClient{}
+	_, e := cli.waitForJob(context.Background(), nil, "gz")
+	assert.Equal(t, codes.Internal, status.Code(e))
+	assert.Equal(t, codes.Internal, errorCode(e))
+
+	job, e := cli.waitForJob(context.Background(), []*base.JobInfo{{JobUuid: "job-1", Done: true}}, "gz")
+	require.NoError(t, e)
+	assert.Equal(t, "job-1", job.GetJobUuid())
+}
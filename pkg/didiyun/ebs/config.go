@@ -0,0 +1,170 @@
+package ebs
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/klog"
+)
+
+// LoadConfigFile reads the yaml file into cfg, fields absent from the file are kept as they are
+func LoadConfigFile(path string, cfg *DriverConfig) error {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return fmt.Errorf("read config file error %w", e)
+	}
+	// unknown fields are rejected, to catch typos of keys
+	if e := yaml.UnmarshalStrict(data, cfg); e != nil {
+		return fmt.Errorf("parse config file %s error %w", path, e)
+	}
+	return nil
+}
+
+// Validate returns all problems of the config in one error
+func (cfg *DriverConfig) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.NodeID != "", "nodeID is required")
+	check(cfg.Endpoint != "", "endpoint is required")
+	check(cfg.Token != "" || cfg.TokenFile != "", "token or tokenFile is required")
+	check(cfg.Timeout >= 0, "timeout %s is negative", cfg.Timeout)
+	check(cfg.LogLevel >= 0, "logLevel %d is negative", cfg.LogLevel)
+	check(cfg.HealthCheckInterval >= 0, "healthCheckInterval %s is negative", cfg.HealthCheckInterval)
+	check(cfg.ShutdownGracePeriod >= 0, "shutdownGracePeriod %s is negative", cfg.ShutdownGracePeriod)
+	check(cfg.MaxVolumesPerNode >= 0, "maxVolumesPerNode %d is negative", cfg.MaxVolumesPerNode)
+	for key, size := range cfg.CapacityQuotas {
+		check(strings.Count(key, "/") == 1, "capacity quota key %s is not like zone/type", key)
+		check(size >= 0, "capacity quota of %s is negative", key)
+	}
+	check(cfg.Retry.InitialBackoff >= 0, "retry.initialBackoff %s is negative", cfg.Retry.InitialBackoff)
+	check(cfg.Retry.MaxBackoff >= 0, "retry.maxBackoff %s is negative", cfg.Retry.MaxBackoff)
+	check(cfg.Retry.Jitter >= 0 && cfg.Retry.Jitter <= 1, "retry.jitter %v is not in [0, 1]", cfg.Retry.Jitter)
+	if e := cfg.RateLimit.validate(); e != nil {
+		problems = append(problems, e.Error())
+	}
+	check(cfg.RateLimit.Global.Burst >= 0, "rateLimit.global.burst %d is negative", cfg.RateLimit.Global.Burst)
+	for op, l := range cfg.RateLimit.Operations {
+		check(l.Burst >= 0, "rateLimit.operations.%s.burst %d is negative", op, l.Burst)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// restartRequired returns names of fields changed, but not reloadable
+func restartRequired(prev, next *DriverConfig) []string {
+	var fields []string
+	for name, changed := range map[string]bool{
+		"nodeID":            prev.NodeID != next.NodeID,
+		"nodeIP":            prev.NodeIP != next.NodeIP,
+		"regionID":          prev.RegionID != next.RegionID,
+		"zoneID":            prev.ZoneID != next.ZoneID,
+		"endpoint":          prev.Endpoint != next.Endpoint,
+		"token":             prev.Token != next.Token,
+		"tokenFile":         prev.TokenFile != next.TokenFile,
+		"httpAddress":       prev.HTTPAddress != next.HTTPAddress,
+		"tracingEndpoint":   prev.TracingEndpoint != next.TracingEndpoint,
+		"capacityQuotas":    !reflect.DeepEqual(prev.CapacityQuotas, next.CapacityQuotas),
+		"volumeNamePrefix":  prev.VolumeNamePrefix != next.VolumeNamePrefix,
+		"maxVolumesPerNode": prev.MaxVolumesPerNode != next.MaxVolumesPerNode,
+		"checkDevice":       prev.CheckDevice != next.CheckDevice,
+	} {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Reload applies log level, timeout, retries, rate limits, health check interval and shutdown grace period of cfg,
+// changes of other fields are logged and ignored until restarting
+func (t *ebs) Reload(cfg *DriverConfig) error {
+	if e := cfg.Validate(); e != nil {
+		return e
+	}
+	// the timeout is of dialing, so clients are dialed again
+	if cfg.Timeout != t.config().Timeout {
+		if e := t.clients.redial(t.dial(cfg.Timeout)); e != nil {
+			return fmt.Errorf("dial didiyun with timeout %s error %w", cfg.Timeout, e)
+		}
+	}
+	if e := t.limited.reconfigure(cfg.RateLimit); e != nil {
+		return e
+	}
+	t.retrying.reconfigure(cfg.Retry)
+	t.health.setInterval(cfg.HealthCheckInterval)
+	setLogLevel(cfg.LogLevel)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if fields := restartRequired(&t.cfg, cfg); len(fields) > 0 {
+		klog.Warningf("changes of %s take effect after restarting", strings.Join(fields, ", "))
+	}
+	// keep fields not reloaded as they are in effect
+	reloaded := t.cfg
+	reloaded.LogLevel = cfg.LogLevel
+	reloaded.Timeout = cfg.Timeout
+	reloaded.Retry = cfg.Retry
+	reloaded.RateLimit = cfg.RateLimit
+	reloaded.HealthCheckInterval = cfg.HealthCheckInterval
+	reloaded.ShutdownGracePeriod = cfg.ShutdownGracePeriod
+	t.cfg = reloaded
+	return nil
+}
+
+func (t *ebs) config() DriverConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cfg
+}
+
+// WatchConfig reloads the config by load when the file changes, until ctx is done.
+// load is expected to read the file, apply overrides and validate the result.
+func (t *ebs) WatchConfig(ctx context.Context, path string, load func() (*DriverConfig, error)) error {
+	return watchFile(ctx, path, func([]byte) {
+		cfg, e := load()
+		if e == nil {
+			e = t.Reload(cfg)
+		}
+		if e != nil {
+			klog.Errorf("reload config file %s error, keep the config in effect: %s", path, e)
+			return
+		}
+		klog.Infof("config file %s reloaded", path)
+	})
+}
+
+// klogFlags are registered only once, as registering again races with logging, and resets flags like skip_headers
+var klogFlags = func() *flag.FlagSet {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	return fs
+}()
+
+// KlogFlags returns flags of klog, which are synced with command line flags at startup
+func KlogFlags() *flag.FlagSet {
+	return klogFlags
+}
+
+// setLogLevel changes verbosity of klog
+func setLogLevel(level int) {
+	// set by the value, as the flag set itself is not safe for concurrent use
+	if e := klogFlags.Lookup("v").Value.Set(strconv.Itoa(level)); e != nil {
+		klog.Errorf("set log level %d error: %s", level, e)
+	}
+}
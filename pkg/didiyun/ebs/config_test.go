@@ -0,0 +1,135 @@
+package ebs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"k8s.io/klog"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	cfg := &DriverConfig{NodeIP: "10.0.0.1"}
+	require.NoError(t, LoadConfigFile("../../../examples/config.yaml", cfg))
+	assert.NoError(t, cfg.Validate())
+
+	assert.Equal(t, "node-1", cfg.NodeID)
+	assert.Equal(t, "10.0.0.1", cfg.NodeIP, "fields absent from the file are kept")
+	assert.Equal(t, 30*time.Second, cfg.Timeout)
+	assert.Equal(t, int64(2048), cfg.CapacityQuotas["gz02/HE"])
+	assert.Equal(t, 30*time.Second, cfg.Retry.MaxBackoff)
+	assert.Equal(t, RateLimit{QPS: 1, Burst: 2}, cfg.RateLimit.Operations[opAttach])
+	assert.True(t, cfg.CheckDevice)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("nodeId: node-1\n"), 0644))
+	assert.Error(t, LoadConfigFile(path, &DriverConfig{}), "unknown fields are rejected")
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := &DriverConfig{
+		Endpoint:       "unix:///csi/csi.sock",
+		Token:          "token",
+		Timeout:        -time.Second,
+		CapacityQuotas: map[string]int64{"gz01": 1024},
+		RateLimit:      RateLimitConfig{Operations: map[string]RateLimit{"resize": {QPS: 1}}},
+	}
+	e := cfg.Validate()
+	require.Error(t, e)
+	for _, problem := range []string{"nodeID is required", "timeout -1s is negative", "gz01 is not like zone/type", "unknown ebs operation resize"} {
+		assert.Contains(t, e.Error(), problem)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfg := DriverConfig{NodeID: "node-1", Endpoint: "unix:///csi/csi.sock", Token: "token"}
+	c, e := didiyunClient.NewMock()
+	require.NoError(t, e)
+	limited, e := newRateLimitedEbsClient(c.Ebs(), cfg.RateLimit)
+	require.NoError(t, e)
+	var dialed []time.Duration
+	var dialedMu sync.Mutex
+	dial := func(timeout time.Duration) newClientsFunc {
+		return func(token string) (*clients, error) {
+			dialedMu.Lock()
+			defer dialedMu.Unlock()
+			dialed = append(dialed, timeout)
+			return &clients{}, nil
+		}
+	}
+	cli, e := newRotatingClient(cfg.Token, dial(cfg.Timeout))
+	require.NoError(t, e)
+	driver := &ebs{
+		clients:  cli,
+		dial:     dial,
+		limited:  limited,
+		retrying: newRetryingEbsClient(limited, cfg.Retry),
+		health:   newHealthChecker(func(ctx context.Context) error { return nil }, 0),
+		cfg:      cfg,
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("nodeID: node-1\n"), 0644))
+	load := func() (*DriverConfig, error) {
+		next := cfg
+		if e := LoadConfigFile(path, &next); e != nil {
+			return nil, e
+		}
+		return &next, next.Validate()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, driver.WatchConfig(ctx, path, load))
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+nodeID: node-2
+timeout: 10s
+retry:
+  maxRetries: -1
+rateLimit:
+  operations:
+    attach:
+      qps: 1
+`), 0644))
+	assert.Eventually(t, func() bool {
+		return driver.config().Retry.MaxRetries == -1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, -1, driver.retrying.config().MaxRetries)
+	assert.NotNil(t, driver.limited.limiters(opAttach)[1], "rate limits are reloaded")
+	assert.Equal(t, "node-1", driver.config().NodeID, "node id is not reloadable")
+	assert.Equal(t, 10*time.Second, driver.config().Timeout)
+	dialedMu.Lock()
+	assert.Equal(t, []time.Duration{0, 10 * time.Second}, dialed, "clients are dialed again with the new timeout")
+	dialedMu.Unlock()
+
+	require.NoError(t, os.WriteFile(path, []byte("timeout: -1s\n"), 0644))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, -1, driver.config().Retry.MaxRetries, "invalid configs are not applied")
+}
+
+func TestSetLogLevel(t *testing.T) {
+	require.NoError(t, klogFlags.Set("skip_headers", "true"))
+	defer klogFlags.Set("skip_headers", "false")
+	defer setLogLevel(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(level int) {
+			defer wg.Done()
+			setLogLevel(level)
+			klog.V(klog.Level(level)).Info("log level is set")
+		}(i)
+	}
+	wg.Wait()
+	setLogLevel(5)
+	assert.True(t, bool(klog.V(5)))
+	assert.False(t, bool(klog.V(6)))
+	assert.Equal(t, "true", klogFlags.Lookup("skip_headers").Value.String(), "other flags are kept")
+}
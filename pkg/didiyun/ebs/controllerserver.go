@@ -3,14 +3,19 @@ package ebs
 import (
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	"github.com/golang/protobuf/ptypes"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	didiyunClient "github.com/supremind/didiyun-client/pkg"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog"
 )
 
 const (
@@ -18,17 +23,47 @@ const (
 	keyZone       = "zoneID"
 	keyType       = "type"
 	keyDeviceName = "deviceName"
+
+	// volumes created by the driver are named by csi-provisioner as <prefix>-<uid>, with its default `--volume-name-prefix`
+	defaultVolumeNamePrefix = "pvc"
+
+	// page sizes used when listing from didiyun
+	volumePageSize   = 100
+	snapshotPageSize = 100
+	// how long CreateSnapshot waits for a new snapshot to become ready, before letting the snapshotter poll again
+	snapshotReadyTimeout = 30 * time.Second
+	snapshotPollInterval = 3 * time.Second
+	// snapshots for cloning volumes are named after the new volume, with this suffix
+	cloneSnapshotSuffix  = "-clone-source"
+	cloneSnapshotTimeout = 5 * time.Minute
+	cleanupTimeout       = time.Minute
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	ebsCli didiyunClient.EbsClient
+	ebsCli   didiyunClient.EbsClient
+	cloudCli cloudClient
+	// region of volumes listed
+	region string
+	// volumes listed are named with the prefix by csi-provisioner
+	namePrefix string
+	// quotas in GiB, keyed by zone and type, like `gz01/SSD`
+	quotas map[string]int64
+	locks  volumeLocks
 }
 
-func NewControllerServer(d *csicommon.CSIDriver, cli didiyunClient.EbsClient) *controllerServer {
+func NewControllerServer(d *csicommon.CSIDriver, cfg *DriverConfig, cli didiyunClient.EbsClient, cloudCli cloudClient) *controllerServer {
+	namePrefix := cfg.VolumeNamePrefix
+	if namePrefix == "" {
+		namePrefix = defaultVolumeNamePrefix
+	}
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		ebsCli:                  cli,
+		cloudCli:                cloudCli,
+		region:                  cfg.RegionID,
+		namePrefix:              namePrefix,
+		quotas:                  cfg.CapacityQuotas,
 	}
 }
 
@@ -39,54 +74,453 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.VolumeCapabilities == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
+	if e := validateFsType(req.GetVolumeCapabilities()...); e != nil {
+		return nil, e
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	// volume ids are not known yet
+	if e := cs.locks.lock(req.GetName()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetName())
 
 	params := req.GetParameters()
-	region := params[keyRegion]
-	zone := params[keyZone]
+	region, zone, e := pickTopology(req.GetAccessibilityRequirements(), params[keyRegion], params[keyZone])
+	if e != nil {
+		return nil, status.Error(codes.InvalidArgument, e.Error())
+	}
 	typ := params[keyType]
-	size := (req.GetCapacityRange().GetRequiredBytes() + (1 << 30) - 1) / (1 << 30)
+	capacity := req.GetCapacityRange().GetRequiredBytes()
 
-	resID, e := cs.ebsCli.Create(ctx, region, zone, req.GetName(), typ, size)
+	// the volume may be created by a previous timed out request
+	existing, e := cs.findVolumeByName(ctx, region, zone, req.GetName())
 	if e != nil {
-		return nil, status.Error(codes.Internal, e.Error())
+		return nil, toStatus(e)
+	}
+	if existing != nil {
+		if e := checkExistingVolume(existing, typ, req.GetCapacityRange()); e != nil {
+			logger(ctx).V(4).Info(e.Error())
+			return nil, status.Error(codes.AlreadyExists, e.Error())
+		}
+		logger(ctx).V(4).Infof("volume %s (%s) already exists", req.GetName(), existing.GetEbsUuid())
+		if region == "" {
+			region = existing.GetRegion().GetId()
+		}
+		if zone == "" {
+			zone = existing.GetRegion().GetZone().GetId()
+		}
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           existing.GetEbsUuid(),
+				CapacityBytes:      existing.GetSize(),
+				VolumeContext:      req.GetParameters(),
+				ContentSource:      req.GetVolumeContentSource(),
+				AccessibleTopology: volumeTopology(region, zone),
+			},
+		}, nil
+	}
+
+	var resID string
+	switch src := req.GetVolumeContentSource(); {
+	case src.GetSnapshot() != nil:
+		resID, capacity, e = cs.restoreSnapshot(ctx, req.GetName(), region, zone, typ, src.GetSnapshot().GetSnapshotId(), capacity)
+	case src.GetVolume() != nil:
+		resID, capacity, e = cs.cloneVolume(ctx, req.GetName(), region, zone, typ, src.GetVolume().GetVolumeId(), capacity)
+	default:
+		size := sizeInGiB(capacity)
+		if resID, e = cs.ebsCli.Create(ctx, region, zone, req.GetName(), typ, size); e != nil {
+			e = toStatus(e)
+		}
+	}
+	if e != nil {
+		return nil, e
 	}
 
 	createVolumeResponse := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      resID, // ebs uuid as volume id
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-			VolumeContext: req.GetParameters(),
-			AccessibleTopology: []*csi.Topology{
-				{
-					Segments: map[string]string{
-						topologyZoneKey: zone,
-					},
-				},
-			},
+			VolumeId:           resID, // ebs uuid as volume id
+			CapacityBytes:      capacity,
+			VolumeContext:      req.GetParameters(),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: volumeTopology(region, zone),
 		},
 	}
-	klog.V(4).Infof("volume created: %s for %s, %v", resID, req.GetName(), req.GetParameters())
+	logger(ctx).V(4).Infof("volume created: %s for %s, %v", resID, req.GetName(), req.GetParameters())
 	return createVolumeResponse, nil
 }
 
+// pickTopology chooses the region and zone to create a volume in, from the preferred and then the requisite topologies.
+// region and zone from storage class parameters are used if no topology is given, or they must be accessible in the requirement.
+func pickTopology(req *csi.TopologyRequirement, region, zone string) (string, string, error) {
+	var candidates []*csi.Topology
+	candidates = append(candidates, req.GetPreferred()...)
+	candidates = append(candidates, req.GetRequisite()...)
+	if len(candidates) == 0 {
+		return region, zone, nil
+	}
+
+	for _, topo := range candidates {
+		topoZone := topo.GetSegments()[topologyZoneKey]
+		topoRegion := topo.GetSegments()[topologyRegionKey]
+		if topoZone == "" {
+			continue
+		}
+		if zone != "" && zone != topoZone {
+			continue
+		}
+		if region != "" && topoRegion != "" && region != topoRegion {
+			continue
+		}
+
+		if topoRegion != "" {
+			region = topoRegion
+		}
+		return region, topoZone, nil
+	}
+
+	if zone != "" {
+		return "", "", fmt.Errorf("zone %s is not accessible in the topology requirement %v", zone, req)
+	}
+	if region != "" {
+		return "", "", fmt.Errorf("region %s is not accessible in the topology requirement %v", region, req)
+	}
+	return "", "", fmt.Errorf("no zone is found in the topology requirement %v", req)
+}
+
+func volumeTopology(region, zone string) []*csi.Topology {
+	segments := map[string]string{topologyZoneKey: zone}
+	if region != "" {
+		segments[topologyRegionKey] = region
+	}
+	return []*csi.Topology{{Segments: segments}}
+}
+
+// findVolumeByName returns nil if no volume is named as name in the region and zone
+func (cs *controllerServer) findVolumeByName(ctx context.Context, region, zone, name string) (*compute.EbsInfo, error) {
+	var start int32
+	for {
+		vols, e := cs.cloudCli.ListEbs(ctx, region, zone, start, volumePageSize)
+		if e != nil {
+			return nil, e
+		}
+		for _, vol := range vols {
+			if vol.GetName() == name {
+				return vol, nil
+			}
+		}
+		if len(vols) < volumePageSize {
+			return nil, nil
+		}
+		start += volumePageSize
+	}
+}
+
+// checkExistingVolume checks if a volume with the same name is compatible with the request
+func checkExistingVolume(vol *compute.EbsInfo, typ string, capRange *csi.CapacityRange) error {
+	if typ != "" && vol.GetType() != typ {
+		return fmt.Errorf("volume %s (%s) already exists with type %s, but %s is requested", vol.GetName(), vol.GetEbsUuid(), vol.GetType(), typ)
+	}
+	// volumes are created in whole GiBs, rounded up from the required bytes, so is the limit
+	if vol.GetSize() < capRange.GetRequiredBytes() || (capRange.GetLimitBytes() > 0 && vol.GetSize() > sizeInGiB(capRange.GetLimitBytes())<<30) {
+		return fmt.Errorf("volume %s (%s) already exists with size %d, which is out of the requested range %v", vol.GetName(), vol.GetEbsUuid(), vol.GetSize(), capRange)
+	}
+	return nil
+}
+
+// sizeInGiB rounds bytes up to GiBs
+func sizeInGiB(bytes int64) int64 {
+	return (bytes + (1 << 30) - 1) / (1 << 30)
+}
+
+// restoreSnapshot creates a volume from the snapshot, returns the volume id and its capacity
+func (cs *controllerServer) restoreSnapshot(ctx context.Context, name, region, zone, typ, snapID string, capacity int64) (string, int64, error) {
+	snap, e := cs.findSnapshotByID(ctx, snapID)
+	if e != nil {
+		return "", 0, toStatus(e)
+	}
+	if snap == nil {
+		return "", 0, status.Errorf(codes.NotFound, "snapshot %s is not found", snapID)
+	}
+	if !snapshotReady(snap) {
+		return "", 0, status.Errorf(codes.Unavailable, "snapshot %s is not ready to use", snapID)
+	}
+	if capacity == 0 {
+		capacity = snap.GetSize()
+	}
+	if capacity < snap.GetSize() {
+		return "", 0, status.Errorf(codes.OutOfRange, "requested size %d is smaller than snapshot %s size %d", capacity, snapID, snap.GetSize())
+	}
+
+	size := sizeInGiB(capacity)
+	resID, e := cs.cloudCli.CreateFromSnapshot(ctx, region, zone, name, typ, snapID, size)
+	if e != nil {
+		return "", 0, toStatus(e)
+	}
+	logger(ctx).V(4).Infof("volume %s is restored from snapshot %s", resID, snapID)
+	return resID, capacity, nil
+}
+
+// cloneVolume creates a volume from another one, through a transient snapshot,
+// which is kept for retries until the volume is created, or the snapshot fails.
+// returns the volume id and its capacity
+func (cs *controllerServer) cloneVolume(ctx context.Context, name, region, zone, typ, srcID string, capacity int64) (string, int64, error) {
+	src, e := cs.ebsCli.Get(ctx, srcID)
+	if e != nil {
+		return "", 0, toStatus(e)
+	}
+	srcRegion := src.GetRegion().GetId()
+	srcZone := src.GetRegion().GetZone().GetId()
+	if region == "" {
+		region = srcRegion
+	}
+	if zone == "" {
+		zone = srcZone
+	}
+	if typ == "" {
+		typ = src.GetType()
+	}
+	if region != srcRegion || zone != srcZone {
+		return "", 0, status.Errorf(codes.InvalidArgument, "could not clone volume %s in %s/%s to %s/%s", srcID, srcRegion, srcZone, region, zone)
+	}
+	if typ != src.GetType() {
+		return "", 0, status.Errorf(codes.InvalidArgument, "could not clone volume %s of type %s to %s", srcID, src.GetType(), typ)
+	}
+	if capacity == 0 {
+		capacity = src.GetSize()
+	}
+	if capacity < src.GetSize() {
+		return "", 0, status.Errorf(codes.OutOfRange, "requested size %d is smaller than source volume %s size %d", capacity, srcID, src.GetSize())
+	}
+
+	// a snapshot left by the previous attempt, which is still in progress or timed out, is reused
+	snapName := name + cloneSnapshotSuffix
+	snap, e := cs.findSnapshotByName(ctx, region, snapName)
+	if e != nil {
+		return "", 0, toStatus(e)
+	}
+	if snap != nil && snap.GetEbs().GetEbsUuid() != srcID {
+		return "", 0, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for another volume %s", snapName, snap.GetEbs().GetEbsUuid())
+	}
+	if snap != nil && snapshotFailed(snap) {
+		// never to be ready, and created again
+		if e := cs.cloudCli.DeleteSnapshot(ctx, region, snap.GetSnapUuid()); e != nil {
+			return "", 0, toStatus(e)
+		}
+		snap = nil
+	}
+	if snap == nil {
+		if _, e := cs.cloudCli.CreateSnapshot(ctx, region, srcID, snapName); e != nil {
+			cs.cleanupCloneSnapshot(ctx, region, snapName, false)
+			return "", 0, toStatus(e)
+		}
+	}
+
+	if snap, e = cs.waitSnapshotReady(ctx, region, snapName, cloneSnapshotTimeout); e != nil {
+		cs.cleanupCloneSnapshot(ctx, region, snapName, false)
+		return "", 0, toStatus(e)
+	}
+	if snapshotFailed(snap) {
+		cs.cleanupCloneSnapshot(ctx, region, snapName, false)
+		return "", 0, status.Errorf(codes.Internal, "transient snapshot %s for cloning volume %s failed: %s", snapName, srcID, snap.GetJob().GetResult())
+	}
+	if !snapshotReady(snap) {
+		// kept for the retry
+		return "", 0, status.Errorf(codes.DeadlineExceeded, "transient snapshot %s for cloning volume %s is not ready in time", snapName, srcID)
+	}
+
+	size := sizeInGiB(capacity)
+	resID, e := cs.cloudCli.CreateFromSnapshot(ctx, region, zone, name, typ, snap.GetSnapUuid(), size)
+	if e != nil {
+		e = toStatus(e)
+		// the ready snapshot is kept only for errors retried by the provisioner
+		switch status.Code(e) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		default:
+			cs.cleanupCloneSnapshot(ctx, region, snapName, true)
+		}
+		return "", 0, e
+	}
+	cs.cleanupCloneSnapshot(ctx, region, snapName, true)
+	logger(ctx).V(4).Infof("volume %s is cloned from %s", resID, srcID)
+	return resID, capacity, nil
+}
+
+// cleanupCloneSnapshot deletes the transient snapshot for cloning if cloning is done,
+// or the snapshot fails, which is looked up by name as it may be left by a failed creation
+func (cs *controllerServer) cleanupCloneSnapshot(ctx context.Context, region, snapName string, done bool) {
+	// the request context may be already done
+	cleanupCtx := withToken(withRequestID(context.Background(), requestID(ctx)), tokenOf(ctx))
+	cleanupCtx, cancel := context.WithTimeout(cleanupCtx, cleanupTimeout)
+	defer cancel()
+
+	snap, e := cs.findSnapshotByName(cleanupCtx, region, snapName)
+	if e != nil {
+		logger(ctx).Errorf("failed to find transient snapshot %s for cloning: %s", snapName, e)
+		return
+	}
+	if snap == nil {
+		return
+	}
+	if !done && !snapshotFailed(snap) {
+		logger(ctx).V(4).Infof("transient snapshot %s for cloning is kept for retries", snapName)
+		return
+	}
+	if e := cs.cloudCli.DeleteSnapshot(cleanupCtx, region, snap.GetSnapUuid()); e != nil {
+		logger(ctx).Errorf("failed to delete transient snapshot %s for cloning: %s", snapName, e)
+	}
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := cs.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetVolumeId())
+
 	if e := cs.ebsCli.Delete(ctx, req.GetVolumeId()); e != nil {
 		if errors.Is(e, didiyunClient.NotFound) {
-			klog.V(3).Infof("couldn't delete not found volume %s", req.GetVolumeId())
+			logger(ctx).V(3).Infof("couldn't delete not found volume %s", req.GetVolumeId())
 			return &csi.DeleteVolumeResponse{}, nil
 		}
-		return nil, status.Error(codes.Internal, e.Error())
+		return nil, toStatus(e)
 	}
 
-	klog.V(4).Infof("volume deleted: %s", req.GetVolumeId())
+	logger(ctx).V(4).Infof("volume deleted: %s", req.GetVolumeId())
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// ListVolumes lists volumes created by the driver.
+// tokens are offsets of all ebs in didiyun, since volumes are filtered by names.
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	var start int32
+	if req.GetStartingToken() != "" {
+		i, e := strconv.ParseInt(req.GetStartingToken(), 10, 32)
+		if e != nil || i < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %s", req.GetStartingToken())
+		}
+		start = int32(i)
+	}
+
+	// volumes are listed by regions
+	if cs.region == "" {
+		return nil, status.Error(codes.FailedPrecondition, "region of the controller is not configured by --regionid")
+	}
+
+	var entries []*csi.ListVolumesResponse_Entry
+	var next string
+	for {
+		vols, e := cs.cloudCli.ListEbs(ctx, cs.region, "", start, volumePageSize)
+		if e != nil {
+			return nil, toStatus(e)
+		}
+		for i, vol := range vols {
+			if !strings.HasPrefix(vol.GetName(), cs.namePrefix+"-") {
+				continue
+			}
+			entries = append(entries, toCSIVolumeEntry(vol))
+			if req.GetMaxEntries() > 0 && int32(len(entries)) == req.GetMaxEntries() {
+				if i+1 < len(vols) || len(vols) == volumePageSize {
+					next = strconv.Itoa(int(start) + i + 1)
+				}
+				return &csi.ListVolumesResponse{Entries: entries, NextToken: next}, nil
+			}
+		}
+		if len(vols) < volumePageSize {
+			return &csi.ListVolumesResponse{Entries: entries}, nil
+		}
+		start += volumePageSize
+	}
+}
+
+func toCSIVolumeEntry(vol *compute.EbsInfo) *csi.ListVolumesResponse_Entry {
+	var nodes []string
+	if vol.GetDc2() != nil {
+		nodes = append(nodes, vol.GetDc2().GetName())
+	}
+	return &csi.ListVolumesResponse_Entry{
+		Volume: &csi.Volume{
+			VolumeId:           vol.GetEbsUuid(),
+			CapacityBytes:      vol.GetSize(),
+			AccessibleTopology: volumeTopology(vol.GetRegion().GetId(), vol.GetRegion().GetZone().GetId()),
+		},
+		Status: &csi.ListVolumesResponse_VolumeStatus{PublishedNodeIds: nodes},
+	}
+}
+
+// GetCapacity reports the remaining capacity of a zone and disk type, which is the configured quota
+// subtracted by the total size of existing volumes. zones or types without quotas are not limited.
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	params := req.GetParameters()
+	region := params[keyRegion]
+	zone := params[keyZone]
+	typ := params[keyType]
+	if seg := req.GetAccessibleTopology().GetSegments(); seg != nil {
+		if seg[topologyZoneKey] != "" {
+			zone = seg[topologyZoneKey]
+		}
+		if seg[topologyRegionKey] != "" {
+			region = seg[topologyRegionKey]
+		}
+	}
+	if zone == "" {
+		return nil, status.Error(codes.InvalidArgument, "zone is required to get capacity")
+	}
+
+	quota, ok := cs.quotas[zone+"/"+typ]
+	if !ok {
+		logger(ctx).V(5).Infof("no quota is configured for %s/%s", zone, typ)
+		return &csi.GetCapacityResponse{AvailableCapacity: math.MaxInt64}, nil
+	}
+
+	var used int64
+	var start int32
+	for {
+		vols, e := cs.cloudCli.ListEbs(ctx, region, zone, start, volumePageSize)
+		if e != nil {
+			return nil, toStatus(e)
+		}
+		for _, vol := range vols {
+			if typ == "" || vol.GetType() == typ {
+				used += vol.GetSize()
+			}
+		}
+		if len(vols) < volumePageSize {
+			break
+		}
+		start += volumePageSize
+	}
+
+	available := quota<<30 - used
+	if available < 0 {
+		available = 0
+	}
+	logger(ctx).V(5).Infof("capacity of %s/%s: quota %d GiB, used %d bytes", zone, typ, quota, used)
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
 func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	caps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+	}
+
+	if len(cs.quotas) > 0 {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_GET_CAPACITY)
 	}
 
 	var csc []*csi.ControllerServiceCapability
@@ -114,37 +548,355 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
+// ControllerPublishVolume attaches the ebs to the dc2 named as the node id,
+// the attached device name is passed to NodeStageVolume by the publish context
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID cannot be empty")
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := cs.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetVolumeId())
+
 	ebs, e := cs.ebsCli.Get(ctx, req.GetVolumeId())
 	if e != nil {
-		return nil, status.Error(codes.Internal, e.Error())
+		return nil, toStatus(e)
 	}
 
 	if ebs.GetDc2() != nil {
 		if ebs.GetDc2().GetName() == req.GetNodeId() {
-			klog.V(4).Infof("ebs %s (%s) already mounted to %s, do nothing", ebs.GetName(), ebs.GetEbsUuid(), req.GetNodeId())
-			return &csi.ControllerPublishVolumeResponse{}, nil
+			logger(ctx).V(4).Infof("ebs %s (%s) already attached to %s as %s, do nothing", ebs.GetName(), ebs.GetEbsUuid(), req.GetNodeId(), ebs.GetDeviceName())
+			return &csi.ControllerPublishVolumeResponse{
+				PublishContext: map[string]string{keyDeviceName: ebs.GetDeviceName()},
+			}, nil
 		}
 
-		msg := fmt.Sprintf("ebs %s (%s) is still mounted to another node %s, could not be published to %s", ebs.GetName(), ebs.GetEbsUuid(), ebs.GetDc2().GetName(), req.GetNodeId())
-		klog.V(4).Info(msg)
+		msg := fmt.Sprintf("ebs %s (%s) is still attached to another node %s, could not be published to %s", ebs.GetName(), ebs.GetEbsUuid(), ebs.GetDc2().GetName(), req.GetNodeId())
+		logger(ctx).V(4).Info(msg)
 		return nil, status.Error(codes.FailedPrecondition, msg)
 	}
 
-	klog.V(4).Infof("ebs %s (%s) is free to be mounted", ebs.GetName(), ebs.GetEbsUuid())
-	return &csi.ControllerPublishVolumeResponse{}, nil
+	// node id is the name of dc2
+	device, e := cs.ebsCli.Attach(ctx, req.GetVolumeId(), req.GetNodeId())
+	if e != nil {
+		return nil, toStatus(e)
+	}
+
+	logger(ctx).V(4).Infof("ebs %s (%s) is attached to %s as %s", ebs.GetName(), ebs.GetEbsUuid(), req.GetNodeId(), device)
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{keyDeviceName: device},
+	}, nil
 }
 
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := cs.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetVolumeId())
+
+	ebs, e := cs.ebsCli.Get(ctx, req.GetVolumeId())
+	if e != nil {
+		return nil, toStatus(e)
+	}
+	if ebs.GetDc2() == nil {
+		logger(ctx).V(4).Infof("ebs %s (%s) is already detached", ebs.GetName(), ebs.GetEbsUuid())
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	// empty node id means detaching from any node
+	if req.GetNodeId() != "" && ebs.GetDc2().GetName() != req.GetNodeId() {
+		logger(ctx).V(4).Infof("ebs %s (%s) is attached to %s, not %s, do nothing", ebs.GetName(), ebs.GetEbsUuid(), ebs.GetDc2().GetName(), req.GetNodeId())
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	if e := cs.ebsCli.Detach(ctx, req.GetVolumeId()); e != nil {
+		return nil, toStatus(e)
+	}
+
+	logger(ctx).V(4).Infof("ebs %s (%s) is detached from %s", ebs.GetName(), ebs.GetEbsUuid(), ebs.GetDc2().GetName())
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+// ControllerExpandVolume expands the ebs, fs on it is grown by NodeExpandVolume unless it is a block volume
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	size := (req.GetCapacityRange().GetRequiredBytes() + (1 << 30) - 1) / (1 << 30)
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	// fs could not be grown by nodes if it is not supported
+	if e := validateFsType(req.GetVolumeCapability()); e != nil {
+		return nil, e
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := cs.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetVolumeId())
+
+	size := sizeInGiB(req.GetCapacityRange().GetRequiredBytes())
 	if e := cs.ebsCli.Expand(ctx, req.GetVolumeId(), size); e != nil {
+		return nil, toStatus(e)
+	}
+
+	logger(ctx).V(4).Infof("volume expanded: %s", req.GetVolumeId())
+	nodeExpansion := req.GetVolumeCapability().GetBlock() == nil
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes(), NodeExpansionRequired: nodeExpansion}, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot Name cannot be empty")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Source Volume ID cannot be empty")
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := cs.locks.lock(req.GetName()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetName())
+
+	ebs, e := cs.ebsCli.Get(ctx, req.GetSourceVolumeId())
+	if e != nil {
+		return nil, toStatus(e)
+	}
+	region := ebs.GetRegion().GetId()
+
+	snap, e := cs.findSnapshotByName(ctx, region, req.GetName())
+	if e != nil {
+		return nil, toStatus(e)
+	}
+	if snap != nil {
+		if snap.GetEbs().GetEbsUuid() != req.GetSourceVolumeId() {
+			msg := fmt.Sprintf("snapshot %s already exists for another volume %s", req.GetName(), snap.GetEbs().GetEbsUuid())
+			logger(ctx).V(4).Info(msg)
+			return nil, status.Error(codes.AlreadyExists, msg)
+		}
+		logger(ctx).V(4).Infof("snapshot %s (%s) already exists", req.GetName(), snap.GetSnapUuid())
+	} else {
+		snapID, e := cs.cloudCli.CreateSnapshot(ctx, region, req.GetSourceVolumeId(), req.GetName())
+		if e != nil {
+			return nil, toStatus(e)
+		}
+		logger(ctx).V(4).Infof("snapshot created: %s for %s, from volume %s", snapID, req.GetName(), req.GetSourceVolumeId())
+
+		if snap, e = cs.waitSnapshotReady(ctx, region, req.GetName(), snapshotReadyTimeout); e != nil {
+			return nil, toStatus(e)
+		}
+	}
+	if snapshotFailed(snap) {
+		return nil, cs.deleteFailedSnapshot(ctx, region, snap)
+	}
+
+	csiSnap, e := toCSISnapshot(snap)
+	if e != nil {
 		return nil, status.Error(codes.Internal, e.Error())
 	}
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnap}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID cannot be empty")
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := cs.locks.lock(req.GetSnapshotId()); e != nil {
+		return nil, e
+	}
+	defer cs.locks.unlock(req.GetSnapshotId())
+
+	snap, e := cs.findSnapshotByID(ctx, req.GetSnapshotId())
+	if e != nil {
+		return nil, toStatus(e)
+	}
+	if snap == nil {
+		logger(ctx).V(3).Infof("couldn't delete not found snapshot %s", req.GetSnapshotId())
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if e := cs.cloudCli.DeleteSnapshot(ctx, snap.GetRegion().GetId(), req.GetSnapshotId()); e != nil {
+		return nil, toStatus(e)
+	}
+
+	logger(ctx).V(4).Infof("snapshot deleted: %s", req.GetSnapshotId())
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	var snaps []*compute.SnapInfo
+	var next string
+
+	if req.GetSnapshotId() != "" {
+		snap, e := cs.findSnapshotByID(ctx, req.GetSnapshotId())
+		if e != nil {
+			return nil, toStatus(e)
+		}
+		if snap != nil && (req.GetSourceVolumeId() == "" || req.GetSourceVolumeId() == snap.GetEbs().GetEbsUuid()) {
+			snaps = append(snaps, snap)
+		}
+	} else {
+		var start int32
+		if req.GetStartingToken() != "" {
+			i, e := strconv.ParseInt(req.GetStartingToken(), 10, 32)
+			if e != nil || i < 0 {
+				return nil, status.Errorf(codes.Aborted, "invalid starting token %s", req.GetStartingToken())
+			}
+			start = int32(i)
+		}
+		limit := int32(snapshotPageSize)
+		if req.GetMaxEntries() > 0 && req.GetMaxEntries() < limit {
+			limit = req.GetMaxEntries()
+		}
+
+		var e error
+		snaps, e = cs.cloudCli.ListSnapshots(ctx, "", req.GetSourceVolumeId(), "", start, limit)
+		if e != nil {
+			return nil, toStatus(e)
+		}
+		if int32(len(snaps)) == limit {
+			next = strconv.Itoa(int(start + limit))
+		}
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(snaps))
+	for _, snap := range snaps {
+		// never to be ready, and deleted by CreateSnapshot
+		if snapshotFailed(snap) {
+			continue
+		}
+		csiSnap, e := toCSISnapshot(snap)
+		if e != nil {
+			return nil, status.Error(codes.Internal, e.Error())
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnap})
+	}
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: next}, nil
+}
+
+// findSnapshotByName returns nil if no snapshot is named as name
+func (cs *controllerServer) findSnapshotByName(ctx context.Context, region, name string) (*compute.SnapInfo, error) {
+	var start int32
+	for {
+		snaps, e := cs.cloudCli.ListSnapshots(ctx, region, "", name, start, snapshotPageSize)
+		if e != nil {
+			return nil, e
+		}
+		for _, snap := range snaps {
+			if snap.GetName() == name { // the name condition may be a fuzzy match
+				return snap, nil
+			}
+		}
+		if len(snaps) < snapshotPageSize {
+			return nil, nil
+		}
+		start += snapshotPageSize
+	}
+}
+
+// findSnapshotByID returns nil if the snapshot is not found
+func (cs *controllerServer) findSnapshotByID(ctx context.Context, snapID string) (*compute.SnapInfo, error) {
+	var start int32
+	for {
+		snaps, e := cs.cloudCli.ListSnapshots(ctx, "", "", "", start, snapshotPageSize)
+		if e != nil {
+			return nil, e
+		}
+		for _, snap := range snaps {
+			if snap.GetSnapUuid() == snapID {
+				return snap, nil
+			}
+		}
+		if len(snaps) < snapshotPageSize {
+			return nil, nil
+		}
+		start += snapshotPageSize
+	}
+}
+
+// waitSnapshotReady polls the newly created snapshot until it is ready to use, failed, or timeout passed.
+// a snapshot not ready yet is returned as well, the snapshotter will keep polling it by CreateSnapshot.
+func (cs *controllerServer) waitSnapshotReady(ctx context.Context, region, name string, timeout time.Duration) (*compute.SnapInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		snap, e := cs.findSnapshotByName(ctx, region, name)
+		if e != nil {
+			return nil, e
+		}
+		if snap == nil {
+			return nil, fmt.Errorf("snapshot %s is not found after created", name)
+		}
+		if snapshotReady(snap) || snapshotFailed(snap) || time.Now().After(deadline) {
+			return snap, nil
+		}
+
+		logger(ctx).V(5).Infof("wait for snapshot %s (%s) to be ready", name, snap.GetSnapUuid())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(snapshotPollInterval):
+		}
+	}
+}
+
+// deleteFailedSnapshot deletes the failed snapshot so that it is created again by the retry,
+// and returns the error of the failure
+func (cs *controllerServer) deleteFailedSnapshot(ctx context.Context, region string, snap *compute.SnapInfo) error {
+	msg := fmt.Sprintf("snapshot %s (%s) failed: %s", snap.GetName(), snap.GetSnapUuid(), snap.GetJob().GetResult())
+	logger(ctx).Errorf("%s", msg)
+	if e := cs.cloudCli.DeleteSnapshot(ctx, region, snap.GetSnapUuid()); e != nil {
+		logger(ctx).Errorf("failed to delete failed snapshot %s: %s", snap.GetSnapUuid(), e)
+	}
+	return status.Error(codes.Internal, msg)
+}
+
+func snapshotReady(snap *compute.SnapInfo) bool {
+	job := snap.GetJob()
+	return job == nil || (job.GetDone() && job.GetSuccess())
+}
+
+// snapshotFailed tells whether the snapshot is never to be ready
+func snapshotFailed(snap *compute.SnapInfo) bool {
+	job := snap.GetJob()
+	return job != nil && job.GetDone() && !job.GetSuccess()
+}
+
+func toCSISnapshot(snap *compute.SnapInfo) (*csi.Snapshot, error) {
+	// didiyun timestamps are in milliseconds
+	created, e := ptypes.TimestampProto(time.Unix(0, snap.GetCreateTime()*int64(time.Millisecond)))
+	if e != nil {
+		return nil, e
+	}
+	return &csi.Snapshot{
+		SnapshotId:     snap.GetSnapUuid(),
+		SourceVolumeId: snap.GetEbs().GetEbsUuid(),
+		SizeBytes:      snap.GetSize(),
+		CreationTime:   created,
+		ReadyToUse:     snapshotReady(snap),
+	}, nil
+}
 
-	klog.V(4).Infof("volume expanded: %s", req.GetVolumeId())
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes(), NodeExpansionRequired: true}, nil
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -2,13 +2,18 @@ package ebs
 
 import (
 	"context"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/didiyun/didiyun-go-sdk/base/v1"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestControllerServer(t *testing.T) {
@@ -17,7 +22,7 @@ func TestControllerServer(t *testing.T) {
 	ebsClient := c.Ebs()
 	driver := csicommon.NewCSIDriver(driverName, csiVersion, nodeID)
 	require.NotNil(t, driver)
-	svr := NewControllerServer(driver, ebsClient)
+	svr := NewControllerServer(driver, &DriverConfig{}, ebsClient, newMockCloudClient())
 	ctx := context.Background()
 	createReq := &csi.CreateVolumeRequest{
 		Name:          "test-vol",
@@ -35,19 +40,55 @@ func TestControllerServer(t *testing.T) {
 		}
 	}
 
+	_, e = svr.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "test-vol-vfat",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "vfat"}}}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(e), "fs type not supported")
+
 	pubReq := &csi.ControllerPublishVolumeRequest{
 		VolumeId: createResp.GetVolume().GetVolumeId(),
 		NodeId:   nodeID,
 	}
+	pubResp, e := svr.ControllerPublishVolume(ctx, pubReq)
+	if assert.NoError(t, e) {
+		assert.NotEmpty(t, pubResp.GetPublishContext()[keyDeviceName])
+	}
+	ebs, e := ebsClient.Get(ctx, pubReq.GetVolumeId())
+	if assert.NoError(t, e) {
+		assert.Equal(t, nodeID, ebs.GetDc2().GetName())
+	}
+	// published again
 	_, e = svr.ControllerPublishVolume(ctx, pubReq)
 	assert.NoError(t, e)
+	// published to another node
+	_, e = svr.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: pubReq.GetVolumeId(), NodeId: "other-node"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(e))
 
 	expandReq := &csi.ControllerExpandVolumeRequest{
 		VolumeId:      createResp.GetVolume().GetVolumeId(),
 		CapacityRange: &csi.CapacityRange{RequiredBytes: 20000},
 	}
+	expandResp, e := svr.ControllerExpandVolume(ctx, expandReq)
+	if assert.NoError(t, e) {
+		assert.True(t, expandResp.GetNodeExpansionRequired())
+	}
+	// xfs is grown by nodes
+	expandReq.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"}}}
+	expandResp, e = svr.ControllerExpandVolume(ctx, expandReq)
+	if assert.NoError(t, e) {
+		assert.True(t, expandResp.GetNodeExpansionRequired())
+	}
+	// nothing to grow on nodes for block volumes
+	expandReq.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	expandResp, e = svr.ControllerExpandVolume(ctx, expandReq)
+	if assert.NoError(t, e) {
+		assert.False(t, expandResp.GetNodeExpansionRequired())
+	}
+	// fs not able to be grown
+	expandReq.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "vfat"}}}
 	_, e = svr.ControllerExpandVolume(ctx, expandReq)
-	assert.NoError(t, e)
+	assert.Equal(t, codes.InvalidArgument, status.Code(e))
 
 	unpubReq := &csi.ControllerUnpublishVolumeRequest{
 		VolumeId: createResp.GetVolume().GetVolumeId(),
@@ -55,8 +96,475 @@ func TestControllerServer(t *testing.T) {
 	}
 	_, e = svr.ControllerUnpublishVolume(ctx, unpubReq)
 	assert.NoError(t, e)
+	ebs, e = ebsClient.Get(ctx, unpubReq.GetVolumeId())
+	if assert.NoError(t, e) {
+		assert.Nil(t, ebs.GetDc2())
+	}
+	// unpublished again
+	_, e = svr.ControllerUnpublishVolume(ctx, unpubReq)
+	assert.NoError(t, e)
 
 	delReq := &csi.DeleteVolumeRequest{VolumeId: createResp.GetVolume().GetVolumeId()}
 	_, e = svr.DeleteVolume(ctx, delReq)
 	assert.NoError(t, e)
 }
+
+func TestControllerServerSnapshot(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{}, c.Ebs(), newMockCloudClient())
+	ctx := context.Background()
+
+	volID, e := svr.ebsCli.Create(ctx, "", "zone1", "test-vol", "", 1)
+	require.NoError(t, e)
+	otherVolID, e := svr.ebsCli.Create(ctx, "", "zone1", "other-vol", "", 1)
+	require.NoError(t, e)
+
+	createReq := &csi.CreateSnapshotRequest{Name: "test-snap", SourceVolumeId: volID}
+	createResp, e := svr.CreateSnapshot(ctx, createReq)
+	require.NoError(t, e)
+	snap := createResp.GetSnapshot()
+	assert.NotEmpty(t, snap.GetSnapshotId())
+	assert.Equal(t, volID, snap.GetSourceVolumeId())
+	assert.True(t, snap.GetReadyToUse())
+
+	// idempotent by name
+	createResp, e = svr.CreateSnapshot(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.Equal(t, snap.GetSnapshotId(), createResp.GetSnapshot().GetSnapshotId())
+	}
+
+	// same name from another volume
+	_, e = svr.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "test-snap", SourceVolumeId: otherVolID})
+	assert.Equal(t, codes.AlreadyExists, status.Code(e))
+
+	_, e = svr.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "other-snap", SourceVolumeId: otherVolID})
+	require.NoError(t, e)
+
+	listResp, e := svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 1})
+	if assert.NoError(t, e) {
+		assert.Len(t, listResp.GetEntries(), 1)
+		assert.NotEmpty(t, listResp.GetNextToken())
+	}
+	listResp, e = svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 1, StartingToken: listResp.GetNextToken()})
+	if assert.NoError(t, e) {
+		assert.Len(t, listResp.GetEntries(), 1)
+	}
+	_, e = svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{StartingToken: "invalid"})
+	assert.Equal(t, codes.Aborted, status.Code(e))
+
+	listResp, e = svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: volID})
+	if assert.NoError(t, e) && assert.Len(t, listResp.GetEntries(), 1) {
+		assert.Equal(t, snap.GetSnapshotId(), listResp.GetEntries()[0].GetSnapshot().GetSnapshotId())
+	}
+	listResp, e = svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: snap.GetSnapshotId()})
+	if assert.NoError(t, e) {
+		assert.Len(t, listResp.GetEntries(), 1)
+	}
+
+	_, e = svr.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshotId()})
+	assert.NoError(t, e)
+	// deleting a not found snapshot succeeds
+	_, e = svr.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshotId()})
+	assert.NoError(t, e)
+
+	listResp, e = svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: snap.GetSnapshotId()})
+	if assert.NoError(t, e) {
+		assert.Empty(t, listResp.GetEntries())
+	}
+}
+
+func TestControllerServerFailedSnapshot(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	cloudCli := newMockCloudClient()
+	svr := NewControllerServer(driver, &DriverConfig{}, c.Ebs(), cloudCli)
+	ctx := context.Background()
+
+	volID, e := svr.ebsCli.Create(ctx, "", "zone1", "test-vol", "", 1)
+	require.NoError(t, e)
+	createReq := &csi.CreateSnapshotRequest{Name: "test-snap", SourceVolumeId: volID}
+
+	// failed snapshots are deleted, so that retries create them again
+	cloudCli.failed = true
+	_, e = svr.CreateSnapshot(ctx, createReq)
+	if assert.Equal(t, codes.Internal, status.Code(e)) {
+		assert.Contains(t, e.Error(), "disk error")
+	}
+	assert.Empty(t, cloudCli.snaps)
+	cloudCli.failed = false
+	createResp, e := svr.CreateSnapshot(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.True(t, createResp.GetSnapshot().GetReadyToUse())
+	}
+	assert.Equal(t, 2, cloudCli.created)
+
+	// failed snapshots found by name, like those failed after timed out
+	cloudCli.snaps[0].Job = &base.JobInfo{Done: true, Result: "disk error"}
+	listResp, e := svr.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	if assert.NoError(t, e) {
+		assert.Empty(t, listResp.GetEntries(), "failed snapshots are not listed")
+	}
+	_, e = svr.CreateSnapshot(ctx, createReq)
+	assert.Equal(t, codes.Internal, status.Code(e))
+	assert.Empty(t, cloudCli.snaps)
+}
+
+func TestControllerServerRestoreSnapshot(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{}, c.Ebs(), newMockCloudClient())
+	ctx := context.Background()
+
+	volID, e := svr.ebsCli.Create(ctx, "", "zone1", "test-vol", "", 1)
+	require.NoError(t, e)
+	snapResp, e := svr.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "test-snap", SourceVolumeId: volID})
+	require.NoError(t, e)
+	snap := snapResp.GetSnapshot()
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.GetSnapshotId()},
+		},
+	}
+	createReq := &csi.CreateVolumeRequest{
+		Name:                "restored-vol",
+		CapacityRange:       &csi.CapacityRange{RequiredBytes: 2 << 30},
+		VolumeCapabilities:  []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{}}},
+		VolumeContentSource: source,
+	}
+	createResp, e := svr.CreateVolume(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.NotEmpty(t, createResp.GetVolume().GetVolumeId())
+		assert.Equal(t, source, createResp.GetVolume().GetContentSource())
+	}
+
+	// defaults to the snapshot size
+	createReq.Name = "restored-vol-default-size"
+	createReq.CapacityRange = nil
+	createResp, e = svr.CreateVolume(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.Equal(t, snap.GetSizeBytes(), createResp.GetVolume().GetCapacityBytes())
+	}
+
+	createReq.Name = "restored-vol-too-small"
+	createReq.CapacityRange = &csi.CapacityRange{RequiredBytes: snap.GetSizeBytes() - 1}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.OutOfRange, status.Code(e))
+
+	createReq.Name = "restored-vol-not-found"
+	createReq.CapacityRange = nil
+	createReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "not-found"},
+		},
+	}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.NotFound, status.Code(e))
+}
+
+func TestControllerServerCloneVolume(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	cloudCli := newMockCloudClient()
+	svr := NewControllerServer(driver, &DriverConfig{}, c.Ebs(), cloudCli)
+	ctx := context.Background()
+
+	volID, e := svr.ebsCli.Create(ctx, "", "", "golden-vol", "", 1)
+	require.NoError(t, e)
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volID},
+		},
+	}
+	createReq := &csi.CreateVolumeRequest{
+		Name:                "cloned-vol",
+		CapacityRange:       &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities:  []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{}}},
+		VolumeContentSource: source,
+	}
+	createResp, e := svr.CreateVolume(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.NotEmpty(t, createResp.GetVolume().GetVolumeId())
+		assert.NotEqual(t, volID, createResp.GetVolume().GetVolumeId())
+		assert.Equal(t, source, createResp.GetVolume().GetContentSource())
+	}
+	assert.Empty(t, cloudCli.snaps, "transient snapshot should be deleted")
+
+	// transient snapshots are kept while in progress, and reused by retries
+	cloudCli.pending = true
+	createReq.Name = "cloned-vol-slow"
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, e = svr.CreateVolume(timeoutCtx, createReq)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e))
+	require.Len(t, cloudCli.snaps, 1, "snapshots in progress are kept")
+	snapID := cloudCli.snaps[0].GetSnapUuid()
+	cloudCli.snaps[0].Job.Done, cloudCli.snaps[0].Job.Success = true, true
+	createResp, e = svr.CreateVolume(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.NotEmpty(t, createResp.GetVolume().GetVolumeId())
+	}
+	assert.Equal(t, 2, cloudCli.created, "the snapshot %s is reused", snapID)
+	assert.Empty(t, cloudCli.snaps, "transient snapshot should be deleted after cloning")
+
+	// failed transient snapshots are deleted
+	createReq.Name = "cloned-vol-failed"
+	timeoutCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, e = svr.CreateVolume(timeoutCtx, createReq)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e))
+	require.Len(t, cloudCli.snaps, 1)
+	failedID := cloudCli.snaps[0].GetSnapUuid()
+	cloudCli.snaps[0].Job.Done = true
+	timeoutCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, e = svr.CreateVolume(timeoutCtx, createReq)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e))
+	if assert.Len(t, cloudCli.snaps, 1) {
+		assert.NotEqual(t, failedID, cloudCli.snaps[0].GetSnapUuid(), "failed snapshots are created again")
+	}
+	cloudCli.snaps[0].Job.Done = true
+	svr.cleanupCloneSnapshot(ctx, "", createReq.Name+cloneSnapshotSuffix, false)
+	assert.Empty(t, cloudCli.snaps, "failed snapshots are deleted")
+	cloudCli.pending = false
+
+	// ready transient snapshots are kept only for retryable errors
+	createReq.Name = "cloned-vol-unavailable"
+	cloudCli.createErr = status.Error(codes.Unavailable, "busy")
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.Unavailable, status.Code(e))
+	assert.Len(t, cloudCli.snaps, 1, "snapshots are kept for retries")
+	cloudCli.createErr = status.Error(codes.ResourceExhausted, "quota exceeded")
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(e))
+	assert.Empty(t, cloudCli.snaps, "snapshots are deleted on final errors")
+	cloudCli.createErr = nil
+
+	// cross zone cloning
+	createReq.Name = "cloned-vol-other-zone"
+	createReq.Parameters = map[string]string{keyZone: "zone2"}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.InvalidArgument, status.Code(e))
+
+	// cross type cloning
+	createReq.Name = "cloned-vol-other-type"
+	createReq.Parameters = map[string]string{keyType: "HE"}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.InvalidArgument, status.Code(e))
+	assert.Empty(t, cloudCli.snaps)
+}
+
+func TestControllerServerIdempotentCreate(t *testing.T) {
+	ebsCli, cloudCli := newMockClients()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{}, ebsCli, cloudCli)
+	ctx := context.Background()
+
+	createReq := &csi.CreateVolumeRequest{
+		Name:               "test-vol",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{}}},
+		Parameters:         map[string]string{keyRegion: "gz", keyZone: "gz01", keyType: "SSD"},
+	}
+	createResp, e := svr.CreateVolume(ctx, createReq)
+	require.NoError(t, e)
+	volID := createResp.GetVolume().GetVolumeId()
+
+	// retried
+	createResp, e = svr.CreateVolume(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.Equal(t, volID, createResp.GetVolume().GetVolumeId())
+		assert.Equal(t, int64(10<<30), createResp.GetVolume().GetCapacityBytes())
+	}
+	assert.Len(t, cloudCli.ebs, 1)
+
+	// retried with limits not in whole GiBs, the volume is created in whole GiBs
+	createReq.Name = "test-vol-limited"
+	createReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 3 << 29, LimitBytes: 7 << 28}
+	createResp, e = svr.CreateVolume(ctx, createReq)
+	require.NoError(t, e)
+	limitedID := createResp.GetVolume().GetVolumeId()
+	createResp, e = svr.CreateVolume(ctx, createReq)
+	if assert.NoError(t, e) {
+		assert.Equal(t, limitedID, createResp.GetVolume().GetVolumeId())
+	}
+	createReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 29, LimitBytes: 1 << 29}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.AlreadyExists, status.Code(e), "2GiB is out of the limit rounded to 1GiB")
+	assert.Len(t, cloudCli.ebs, 2)
+	createReq.Name = "test-vol"
+
+	// conflicts in size
+	createReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 20 << 30}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.AlreadyExists, status.Code(e))
+
+	// conflicts in type
+	createReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 10 << 30}
+	createReq.Parameters = map[string]string{keyRegion: "gz", keyZone: "gz01", keyType: "HE"}
+	_, e = svr.CreateVolume(ctx, createReq)
+	assert.Equal(t, codes.AlreadyExists, status.Code(e))
+	assert.Len(t, cloudCli.ebs, 2)
+}
+
+func TestPickTopology(t *testing.T) {
+	topo := func(region, zone string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{topologyRegionKey: region, topologyZoneKey: zone}}
+	}
+	req := &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{topo("gz", "gz01"), topo("gz", "gz02")},
+		Preferred: []*csi.Topology{topo("gz", "gz02"), topo("gz", "gz01")},
+	}
+
+	cases := []struct {
+		name         string
+		req          *csi.TopologyRequirement
+		region, zone string
+		wantRegion   string
+		wantZone     string
+		wantErr      bool
+	}{
+		{name: "parameters only", region: "gz", zone: "gz01", wantRegion: "gz", wantZone: "gz01"},
+		{name: "preferred first", req: req, wantRegion: "gz", wantZone: "gz02"},
+		{name: "requisite only", req: &csi.TopologyRequirement{Requisite: req.Requisite}, wantRegion: "gz", wantZone: "gz01"},
+		{name: "parameter in requirement", req: req, zone: "gz01", wantRegion: "gz", wantZone: "gz01"},
+		{name: "parameter conflicts zone", req: req, zone: "gz03", wantErr: true},
+		{name: "parameter conflicts region", req: req, region: "bj", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			region, zone, e := pickTopology(c.req, c.region, c.zone)
+			if c.wantErr {
+				assert.Error(t, e)
+				return
+			}
+			if assert.NoError(t, e) {
+				assert.Equal(t, c.wantRegion, region)
+				assert.Equal(t, c.wantZone, zone)
+			}
+		})
+	}
+}
+
+func TestControllerServerListVolumes(t *testing.T) {
+	ebsCli, cloudCli := newMockClients()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{RegionID: "gz"}, ebsCli, cloudCli)
+	ctx := context.Background()
+
+	_, e := ebsCli.Create(ctx, "bj", "bj01", "pvc-other-region", "SSD", 1)
+	require.NoError(t, e)
+	var volIDs []string
+	for _, name := range []string{"pvc-1", "not-managed", "pvc-2", "pvc-3"} {
+		id, e := ebsCli.Create(ctx, "gz", "gz01", name, "SSD", 1)
+		require.NoError(t, e)
+		if name != "not-managed" {
+			volIDs = append(volIDs, id)
+		}
+	}
+	_, e = ebsCli.Attach(ctx, volIDs[1], "test-node")
+	require.NoError(t, e)
+
+	resp, e := svr.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, e)
+	var got []string
+	for _, entry := range resp.GetEntries() {
+		got = append(got, entry.GetVolume().GetVolumeId())
+	}
+	assert.Equal(t, volIDs, got)
+	assert.Empty(t, resp.GetNextToken())
+	assert.Equal(t, []string{"test-node"}, resp.GetEntries()[1].GetStatus().GetPublishedNodeIds())
+	assert.Empty(t, resp.GetEntries()[0].GetStatus().GetPublishedNodeIds())
+
+	// paging
+	got = nil
+	var token string
+	for {
+		resp, e := svr.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		require.NoError(t, e)
+		assert.LessOrEqual(t, len(resp.GetEntries()), 2)
+		for _, entry := range resp.GetEntries() {
+			got = append(got, entry.GetVolume().GetVolumeId())
+		}
+		if token = resp.GetNextToken(); token == "" {
+			break
+		}
+	}
+	assert.Equal(t, volIDs, got)
+
+	_, e = svr.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid"})
+	assert.Equal(t, codes.Aborted, status.Code(e))
+
+	svr.region = ""
+	_, e = svr.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(e), "region is required")
+
+	// named by csi-provisioner with another prefix
+	svr = NewControllerServer(driver, &DriverConfig{RegionID: "gz", VolumeNamePrefix: "ebs"}, ebsCli, cloudCli)
+	id, e := ebsCli.Create(ctx, "gz", "gz01", "ebs-1", "SSD", 1)
+	require.NoError(t, e)
+	_, e = ebsCli.Create(ctx, "gz", "gz01", "ebsvol", "SSD", 1)
+	require.NoError(t, e)
+	resp, e = svr.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if assert.NoError(t, e) && assert.Len(t, resp.GetEntries(), 1) {
+		assert.Equal(t, id, resp.GetEntries()[0].GetVolume().GetVolumeId())
+	}
+}
+
+func TestControllerServerGetCapacity(t *testing.T) {
+	ebsCli, cloudCli := newMockClients()
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{CapacityQuotas: map[string]int64{"gz01/SSD": 100, "gz02/SSD": 10}}, ebsCli, cloudCli)
+	ctx := context.Background()
+
+	capResp, e := svr.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	require.NoError(t, e)
+	var hasCap bool
+	for _, c := range capResp.GetCapabilities() {
+		if c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_GET_CAPACITY {
+			hasCap = true
+		}
+	}
+	assert.True(t, hasCap)
+
+	for name, size := range map[string]int64{"pvc-1": 30, "pvc-2": 20} {
+		_, e := ebsCli.Create(ctx, "gz", "gz01", name, "SSD", size)
+		require.NoError(t, e)
+	}
+	_, e = ebsCli.Create(ctx, "gz", "gz01", "pvc-3", "HE", 40)
+	require.NoError(t, e)
+	_, e = ebsCli.Create(ctx, "gz", "gz02", "pvc-4", "SSD", 20)
+	require.NoError(t, e)
+
+	getCap := func(zone, typ string) (int64, error) {
+		resp, e := svr.GetCapacity(ctx, &csi.GetCapacityRequest{
+			Parameters:         map[string]string{keyType: typ},
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyZoneKey: zone}},
+		})
+		return resp.GetAvailableCapacity(), e
+	}
+
+	available, e := getCap("gz01", "SSD")
+	if assert.NoError(t, e) {
+		assert.Equal(t, int64(50<<30), available)
+	}
+	available, e = getCap("gz02", "SSD")
+	if assert.NoError(t, e) {
+		assert.Zero(t, available, "quota exceeded")
+	}
+	available, e = getCap("gz01", "HE")
+	if assert.NoError(t, e) {
+		assert.Equal(t, int64(math.MaxInt64), available, "no quota for HE")
+	}
+	_, e = svr.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(e))
+}
@@ -0,0 +1,191 @@
+package ebs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultDeviceWaitTimeout  = time.Minute
+	defaultDeviceWaitInterval = time.Second
+	// serials shorter are not trusted to tell volumes apart
+	minSerialLength = 8
+)
+
+// deviceResolver finds devices of volumes by serials, which are ebs uuids, or prefixes of them if truncated,
+// as device names reported by didiyun are not always the same as those in the guest
+type deviceResolver struct {
+	// roots of /dev and /sys, replaced by fake trees in tests
+	devDir string
+	sysDir string
+
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func newDeviceResolver() *deviceResolver {
+	return &deviceResolver{
+		devDir:   "/dev",
+		sysDir:   "/sys",
+		timeout:  defaultDeviceWaitTimeout,
+		interval: defaultDeviceWaitInterval,
+	}
+}
+
+// resolve waits until the device of the volume appears, and returns its path.
+// hint is the device name reported by didiyun, which is only used if no device has serials of the volume in time,
+// for images without serials, and if it exists and has no serials of other volumes.
+func (r *deviceResolver) resolve(ctx context.Context, volumeID, hint string) (string, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	var serials map[string][]string
+	for {
+		var e error
+		if serials, e = r.serials(); e != nil {
+			return "", status.Errorf(codes.Internal, "find device of volume %s error %s", volumeID, e)
+		}
+		devices := devicesOf(serials, volumeID)
+		if len(devices) == 1 {
+			if hint != "" && hint != devices[0] {
+				logger(ctx).Warningf("volume %s is found as %s by serial, but reported as %s", volumeID, devices[0], hint)
+			}
+			return filepath.Join(r.devDir, devices[0]), nil
+		}
+		if len(devices) > 1 {
+			// never guess, or the wrong disk may be formatted
+			return "", status.Errorf(codes.FailedPrecondition, "volume %s matches devices %s by serial", volumeID, strings.Join(devices, ", "))
+		}
+		// scanned once more after waiting is over
+		if waitCtx.Err() != nil {
+			break
+		}
+
+		logger(ctx).V(4).Infof("waiting for device of volume %s", volumeID)
+		select {
+		case <-waitCtx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	// serials may be published later than devices, so the hint is never used before waiting is over
+	if ctx.Err() != nil {
+		return "", status.Errorf(codes.DeadlineExceeded, "device of volume %s does not appear: %s", volumeID, ctx.Err())
+	}
+	ok, e := r.unclaimed(serials, hint)
+	if e != nil {
+		return "", status.Errorf(codes.Internal, "find device %s of volume %s error %s", hint, volumeID, e)
+	}
+	if !ok {
+		return "", status.Errorf(codes.DeadlineExceeded, "device of volume %s does not appear in %s", volumeID, r.timeout)
+	}
+	logger(ctx).Warningf("no device has serials of volume %s in %s, falling back to %s reported by didiyun", volumeID, r.timeout, hint)
+	return filepath.Join(r.devDir, hint), nil
+}
+
+// unclaimed tells whether the device exists without any serial, so it could be of any volume
+func (r *deviceResolver) unclaimed(serials map[string][]string, device string) (bool, error) {
+	if device == "" || len(serials[device]) > 0 {
+		return false, nil
+	}
+	if _, e := os.Stat(filepath.Join(r.devDir, device)); e != nil {
+		if os.IsNotExist(e) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+// devicesOf returns sorted names of devices with serials of the volume
+func devicesOf(serials map[string][]string, volumeID string) []string {
+	var devices []string
+	for device, ss := range serials {
+		for _, serial := range ss {
+			if serialMatches(serial, volumeID) {
+				devices = append(devices, device)
+				break
+			}
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// serials returns serials of devices by names, by udev links and sysfs
+func (r *deviceResolver) serials() (map[string][]string, error) {
+	serials := make(map[string][]string)
+
+	// named like virtio-<serial>, or scsi-0QEMU_QEMU_HARDDISK_<serial>
+	byID := filepath.Join(r.devDir, "disk", "by-id")
+	links, e := os.ReadDir(byID)
+	if e != nil && !os.IsNotExist(e) {
+		return nil, e
+	}
+	for _, link := range links {
+		name := link.Name()
+		if strings.Contains(name, "-part") {
+			continue
+		}
+		serial := serialOfLink(name)
+		if serial == "" {
+			continue
+		}
+		target, e := os.Readlink(filepath.Join(byID, name))
+		if e != nil {
+			return nil, e
+		}
+		device := filepath.Base(target)
+		serials[device] = append(serials[device], serial)
+	}
+
+	// serials exposed by drivers, for nodes without udev
+	blocks, e := os.ReadDir(filepath.Join(r.sysDir, "block"))
+	if e != nil && !os.IsNotExist(e) {
+		return nil, e
+	}
+	for _, block := range blocks {
+		for _, attr := range []string{"serial", "device/serial", "device/wwid"} {
+			data, e := os.ReadFile(filepath.Join(r.sysDir, "block", block.Name(), attr))
+			if e != nil {
+				continue
+			}
+			// wwids are like "t10.ATA     QEMU HARDDISK     <serial>"
+			fields := strings.Fields(string(data))
+			if len(fields) > 0 {
+				serials[block.Name()] = append(serials[block.Name()], fields[len(fields)-1])
+			}
+		}
+	}
+	return serials, nil
+}
+
+// serialOfLink returns the serial in the name of a link in /dev/disk/by-id
+func serialOfLink(name string) string {
+	// without the bus
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return ""
+	}
+	name = name[i+1:]
+	// without the vendor and model
+	return name[strings.LastIndex(name, "_")+1:]
+}
+
+// serialMatches tells whether the serial is the volume id, or a prefix of it if truncated
+func serialMatches(serial, volumeID string) bool {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, "-", ""))
+	}
+	s, v := normalize(serial), normalize(volumeID)
+	return len(s) >= minSerialLength && strings.HasPrefix(v, s)
+}
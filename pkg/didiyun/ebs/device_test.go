@@ -0,0 +1,126 @@
+package ebs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newFakeDevices returns a resolver of fake /dev and /sys trees
+func newFakeDevices(t *testing.T) *deviceResolver {
+	root := t.TempDir()
+	return &deviceResolver{
+		devDir:   filepath.Join(root, "dev"),
+		sysDir:   filepath.Join(root, "sys"),
+		timeout:  time.Second,
+		interval: 10 * time.Millisecond,
+	}
+}
+
+// plugDisk adds a disk with the serial to the fake trees, named by udev links if byID, or exposed by sysfs otherwise
+func plugDisk(t *testing.T, r *deviceResolver, name, serial string, byID bool) {
+	require.NoError(t, os.MkdirAll(r.devDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(r.devDir, name), nil, 0644))
+	block := filepath.Join(r.sysDir, "block", name)
+	require.NoError(t, os.MkdirAll(block, 0755))
+	if !byID {
+		require.NoError(t, os.WriteFile(filepath.Join(block, "serial"), []byte(serial+"\n"), 0644))
+		return
+	}
+	links := filepath.Join(r.devDir, "disk", "by-id")
+	require.NoError(t, os.MkdirAll(links, 0755))
+	require.NoError(t, os.Symlink("../../"+name, filepath.Join(links, "virtio-"+serial)))
+	require.NoError(t, os.Symlink("../../"+name+"1", filepath.Join(links, "virtio-"+serial+"-part1")))
+}
+
+// virtioSerial returns the serial of the volume as exposed by virtio, truncated to 20 characters
+func virtioSerial(volumeID string) string {
+	return strings.ReplaceAll(volumeID, "-", "")[:20]
+}
+
+func TestSerialMatches(t *testing.T) {
+	volumeID := "4f9b3a1e-5c2d-11ee-8c99-0242ac120002"
+	assert.True(t, serialMatches(volumeID, volumeID))
+	assert.True(t, serialMatches("4f9b3a1e5c2d11ee8c99", volumeID))
+	assert.True(t, serialMatches("4F9B3A1E5C2D11EE8C99", volumeID))
+	assert.False(t, serialMatches("4f9b3a1e5c2d11ee8c98", volumeID))
+	assert.False(t, serialMatches("4f9b", volumeID), "short serials are not trusted")
+	assert.False(t, serialMatches("", volumeID))
+
+	assert.Equal(t, "4f9b3a1e5c2d11ee8c99", serialOfLink("virtio-4f9b3a1e5c2d11ee8c99"))
+	assert.Equal(t, "4f9b3a1e5c2d11ee8c99", serialOfLink("scsi-0QEMU_QEMU_HARDDISK_4f9b3a1e5c2d11ee8c99"))
+	assert.Equal(t, volumeID, serialOfLink("nvme-"+volumeID))
+	assert.Equal(t, "", serialOfLink("unknown"))
+}
+
+func TestResolveDevice(t *testing.T) {
+	ctx := context.Background()
+	vol1, vol2, vol3 := "4f9b3a1e-5c2d-11ee-8c99-0242ac120002", "7d0c1e2a-5c2d-11ee-8c99-0242ac120002", "9a8b7c6d-5c2d-11ee-8c99-0242ac120002"
+	r := newFakeDevices(t)
+	plugDisk(t, r, "vda", "system-disk", false)
+	plugDisk(t, r, "vdb", virtioSerial(vol1), true)
+	plugDisk(t, r, "vdc", virtioSerial(vol2), false)
+
+	device, e := r.resolve(ctx, vol1, "vdb")
+	require.NoError(t, e)
+	assert.Equal(t, filepath.Join(r.devDir, "vdb"), device)
+	device, e = r.resolve(ctx, vol2, "vdb")
+	require.NoError(t, e)
+	assert.Equal(t, filepath.Join(r.devDir, "vdc"), device, "names reported by didiyun are not trusted")
+
+	// devices appear later
+	resolved := make(chan string, 1)
+	go func() {
+		device, e := r.resolve(ctx, vol3, "")
+		assert.NoError(t, e)
+		resolved <- device
+	}()
+	time.Sleep(100 * time.Millisecond)
+	plugDisk(t, r, "vdd", virtioSerial(vol3), true)
+	assert.Equal(t, filepath.Join(r.devDir, "vdd"), <-resolved)
+
+	// never appear
+	r.timeout = 50 * time.Millisecond
+	vol4 := "0e1f2a3b-5c2d-11ee-8c99-0242ac120002"
+	_, e = r.resolve(ctx, vol4, "vde")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e))
+
+	// no serials in the image, reported names are used if not claimed by other serials
+	require.NoError(t, os.WriteFile(filepath.Join(r.devDir, "vdf"), nil, 0644))
+	device, e = r.resolve(ctx, vol4, "vdf")
+	require.NoError(t, e)
+	assert.Equal(t, filepath.Join(r.devDir, "vdf"), device)
+	_, e = r.resolve(ctx, vol4, "vdc")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e), "vdc is of another volume")
+	_, e = r.resolve(ctx, vol4, "vda")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e), "vda has its own serial")
+	_, e = r.resolve(ctx, vol4, "")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(e))
+
+	// serials published later than devices
+	r.timeout = time.Second
+	vol5 := "1b2c3d4e-5c2d-11ee-8c99-0242ac120002"
+	require.NoError(t, os.WriteFile(filepath.Join(r.devDir, "vdg"), nil, 0644))
+	go func() {
+		device, e := r.resolve(ctx, vol5, "vdg")
+		assert.NoError(t, e)
+		resolved <- device
+	}()
+	time.Sleep(100 * time.Millisecond)
+	plugDisk(t, r, "vdh", virtioSerial(vol5), true)
+	assert.Equal(t, filepath.Join(r.devDir, "vdh"), <-resolved, "reported names are not used before waiting is over")
+	r.timeout = 50 * time.Millisecond
+
+	// ambiguous
+	plugDisk(t, r, "vde", virtioSerial(vol1), false)
+	_, e = r.resolve(ctx, vol1, "vdb")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(e))
+}
@@ -1,12 +1,17 @@
 package ebs
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
-	didiyunClient "github.com/supremind/didiyun-client/pkg"
 	"k8s.io/klog"
 )
 
@@ -19,26 +24,91 @@ const (
 
 type ebs struct {
 	endpoint         string
+	httpAddress      string
+	tracingEndpoint  string
+	tokenFile        string
+	clients          *rotatingClient
+	dial             func(timeout time.Duration) newClientsFunc
+	health           *healthChecker
+	limited          *rateLimitedEbsClient
+	retrying         *retryingEbsClient
 	idServer         csi.IdentityServer
 	nodeServer       csi.NodeServer
 	controllerServer csi.ControllerServer
+
+	mu sync.Mutex
+	// the config in effect, updated by reloading
+	cfg DriverConfig
 }
 
+// DriverConfig could be loaded from a yaml file by LoadConfigFile.
+// log level, timeout, retries, rate limits, health check interval and shutdown grace period could be reloaded at runtime,
+// changes of other fields take effect after restarting.
 type DriverConfig struct {
-	NodeID   string
-	NodeIP   string
-	RegionID string
-	ZoneID   string
-	Endpoint string
-	Token    string
-	Timeout  time.Duration
+	NodeID   string `yaml:"nodeID"`
+	NodeIP   string `yaml:"nodeIP"`
+	RegionID string `yaml:"regionID"`
+	ZoneID   string `yaml:"zoneID"`
+	Endpoint string `yaml:"endpoint"`
+	Token    string `yaml:"token"`
+	// file of the token, watched to rotate the token on changes, preferred to Token
+	TokenFile string `yaml:"tokenFile"`
+	// timeout of connecting didiyun
+	Timeout time.Duration `yaml:"timeout"`
+	// verbosity of logs
+	LogLevel int `yaml:"logLevel"`
+	// address to serve metrics and health checks, disabled if empty
+	HTTPAddress string `yaml:"httpAddress"`
+	// results of health checks are cached for the interval
+	HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+	// quotas in GiB, keyed by zone and type, like `gz01/SSD`
+	CapacityQuotas map[string]int64 `yaml:"capacityQuotas"`
+	// `--volume-name-prefix` of csi-provisioner, only volumes named with it are listed, default is pvc
+	VolumeNamePrefix string `yaml:"volumeNamePrefix"`
+	// retries of failed ebs api calls
+	Retry RetryConfig `yaml:"retry"`
+	// rate limits of ebs api calls, applied before retrying
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	// otlp grpc endpoint to export traces, tracing is disabled if empty
+	TracingEndpoint string `yaml:"tracingEndpoint"`
+	// time to wait for in-flight requests to finish on SIGTERM or SIGINT, default is 25s
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod"`
+	// max volumes attached to a node, default is 5
+	MaxVolumesPerNode int64 `yaml:"maxVolumesPerNode"`
+	// check devices of volumes before unmounting, for troubleshooting
+	CheckDevice bool `yaml:"checkDevice"`
 }
 
 func NewDriver(cfg *DriverConfig) (*ebs, error) {
-	cli, e := didiyunClient.New(&didiyunClient.Config{Token: cfg.Token, Timeout: cfg.Timeout})
+	if e := cfg.Validate(); e != nil {
+		return nil, e
+	}
+	setLogLevel(cfg.LogLevel)
+
+	token := cfg.Token
+	if cfg.TokenFile != "" {
+		var e error
+		if token, e = readTokenFile(cfg.TokenFile); e != nil {
+			return nil, e
+		}
+	}
+	cli, e := newRotatingClient(token, dialClients(cfg.Timeout))
 	if e != nil {
 		return nil, e
 	}
+	limited, e := newRateLimitedEbsClient(newTracingEbsClient(newMetricsEbsClient(cli)), cfg.RateLimit)
+	if e != nil {
+		return nil, e
+	}
+	ebsCli := newRetryingEbsClient(limited, cfg.Retry)
+	limitedCloud := limited.cloud(newTracingCloudClient(newMetricsCloudClient(cli)))
+	cloudCli := ebsCli.cloud(limitedCloud)
+
+	health := newHealthChecker(func(ctx context.Context) error {
+		// counted against rate limits, but not retried, to tell failures in time
+		_, e := limitedCloud.ListEbs(ctx, cfg.RegionID, "", 0, 1)
+		return e
+	}, cfg.HealthCheckInterval)
 
 	driver := csicommon.NewCSIDriver(driverName, csiVersion, cfg.NodeID)
 	if driver == nil {
@@ -46,16 +116,74 @@ func NewDriver(cfg *DriverConfig) (*ebs, error) {
 	}
 	driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 	return &ebs{
-		idServer:         NewIdentityServer(driver),
-		nodeServer:       NewNodeServer(driver, cfg.NodeID, cfg.NodeIP, cfg.RegionID, cfg.ZoneID, cli.Ebs()),
-		controllerServer: NewControllerServer(driver, cli.Ebs()),
+		idServer:         NewIdentityServer(driver, health),
+		nodeServer:       NewNodeServer(driver, cfg, ebsCli),
+		controllerServer: NewControllerServer(driver, cfg, ebsCli, cloudCli),
 		endpoint:         cfg.Endpoint,
+		httpAddress:      cfg.HTTPAddress,
+		tracingEndpoint:  cfg.TracingEndpoint,
+		health:           health,
+		limited:          limited,
+		retrying:         ebsCli,
+		clients:          cli,
+		dial:             dialClients,
+		tokenFile:        cfg.TokenFile,
+		cfg:              *cfg,
 	}, nil
 }
 
 func (t *ebs) Run() {
 	klog.Infof("Starting csi-plugin Driver: %v version: %v", driverName, csiVersion)
-	s := csicommon.NewNonBlockingGRPCServer()
+	if t.httpAddress != "" {
+		go t.serveHTTP()
+	}
+
+	if t.tracingEndpoint != "" {
+		shutdown, e := setupTracing(context.Background(), t.tracingEndpoint)
+		if e != nil {
+			klog.Fatalf("Failed to setup tracing: %s", e)
+		}
+		defer func() {
+			if e := shutdown(context.Background()); e != nil {
+				klog.Errorf("failed to flush traces: %s", e)
+			}
+		}()
+		klog.Infof("Exporting traces to %s", t.tracingEndpoint)
+	}
+
+	if t.tokenFile != "" {
+		if e := t.clients.watchTokenFile(context.Background(), t.tokenFile); e != nil {
+			klog.Fatalf("Failed to watch token file: %s", e)
+		}
+	}
+
+	s := newNonBlockingGRPCServer(tracingInterceptor, loggingInterceptor, metricsInterceptor)
 	s.Start(t.endpoint, t.idServer, t.controllerServer, t.nodeServer)
-	s.Wait()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	served := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(served)
+	}()
+
+	select {
+	case sig := <-signals:
+		grace := t.config().ShutdownGracePeriod
+		klog.Infof("Received %s, draining in-flight requests in %s", sig, grace)
+		s.drain(grace)
+		<-served
+	case <-served:
+	}
+}
+
+func (t *ebs) serveHTTP() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/healthz", t.health)
+	klog.Infof("Serving metrics and health checks on %s", t.httpAddress)
+	if e := http.ListenAndServe(t.httpAddress, mux); e != nil {
+		klog.Errorf("http server stopped: %s", e)
+	}
 }
@@ -0,0 +1,67 @@
+package ebs
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// didiyun apis report most failures by messages only, so errors are classified by keywords in the messages.
+// the first matched class wins.
+var errorClasses = []struct {
+	code     codes.Code
+	keywords []string
+}{
+	{codes.NotFound, []string{"not found", "got nothing", "找不到", "不存在"}},
+	// throttling is retried, and checked before quotas, as messages like "rate limit exceeded" mention both
+	{codes.Unavailable, []string{"throttl", "too many requests", "rate limit", "frequency", "unavailable", "频繁", "限流"}},
+	{codes.ResourceExhausted, []string{"quota", "insufficient", "配额", "不足"}},
+	{codes.InvalidArgument, []string{"invalid", "illegal", "can not shrink", "参数"}},
+	{codes.DeadlineExceeded, []string{"timeout", "timed out", "超时"}},
+	{codes.Aborted, []string{"in progress", "already exist", "conflict", "busy", "正在", "已存在", "占用"}},
+}
+
+// errorCode classifies errors returned by didiyun apis into grpc codes, unknown errors are treated as internal ones
+func errorCode(e error) codes.Code {
+	if e == nil {
+		return codes.OK
+	}
+	if errors.Is(e, didiyunClient.NotFound) {
+		return codes.NotFound
+	}
+	if errors.Is(e, context.DeadlineExceeded) {
+		return codes.DeadlineExceeded
+	}
+	if errors.Is(e, context.Canceled) {
+		return codes.Canceled
+	}
+	// errors from the grpc transport to didiyun
+	if s, ok := status.FromError(e); ok && s.Code() != codes.Unknown {
+		return s.Code()
+	}
+
+	msg := strings.ToLower(e.Error())
+	for _, c := range errorClasses {
+		for _, kw := range c.keywords {
+			if strings.Contains(msg, kw) {
+				return c.code
+			}
+		}
+	}
+	return codes.Internal
+}
+
+// toStatus translates errors returned by didiyun apis into grpc status errors
+func toStatus(e error) error {
+	if e == nil {
+		return nil
+	}
+	if _, ok := e.(interface{ GRPCStatus() *status.Status }); ok {
+		return e
+	}
+	return status.Error(errorCode(e), e.Error())
+}
@@ -0,0 +1,53 @@
+package ebs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		e    error
+		code codes.Code
+	}{
+		{nil, codes.OK},
+		{fmt.Errorf("failed to delete ebs: %w", didiyunClient.NotFound), codes.NotFound},
+		{errors.New("ebs 123 not found"), codes.NotFound},
+		{errors.New("get ebs by uuid, got nothing"), codes.NotFound},
+		{errors.New("create ebs error 超出配额 (41001)"), codes.ResourceExhausted},
+		{errors.New("create ebs error Invalid disk type (40001)"), codes.InvalidArgument},
+		{errors.New("can not shrink size from 20"), codes.InvalidArgument},
+		{errors.New("attach ebs error 请求过于频繁 (42900)"), codes.Unavailable},
+		{errors.New("list ebs error rate limit exceeded (42900)"), codes.Unavailable},
+		{errors.New("list ebs error request frequency exceeded"), codes.Unavailable},
+		{errors.New("create ebs error quota exceeded (41001)"), codes.ResourceExhausted},
+		{fmt.Errorf("get ebs error %w", status.Error(codes.Unavailable, "connection refused")), codes.Unavailable},
+		{fmt.Errorf("job result error %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{errors.New("failed to attach ebs: request timeout"), codes.DeadlineExceeded},
+		{errors.New("failed to detach ebs: ebs is busy, job in progress"), codes.Aborted},
+		{errors.New("pvc-1 already exist"), codes.Aborted},
+		{errors.New("something wrong"), codes.Internal},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.code, errorCode(c.e), "%v", c.e)
+	}
+}
+
+func TestToStatus(t *testing.T) {
+	assert.NoError(t, toStatus(nil))
+
+	e := status.Error(codes.OutOfRange, "too small")
+	assert.Equal(t, e, toStatus(e), "status errors are kept")
+
+	e = toStatus(errors.New("ebs 123 not found"))
+	assert.Equal(t, codes.NotFound, status.Code(e))
+	assert.Equal(t, "ebs 123 not found", status.Convert(e).Message())
+}
@@ -0,0 +1,136 @@
+package ebs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultFsType = "ext4"
+
+// filesystem formats, checks, grows and reports usage of a fs type,
+// implementations are registered by init of their own files
+type filesystem interface {
+	// name of the fs type, as known by mount(8) and blkid(8)
+	name() string
+	// format makes the fs on a blank device
+	format(ctx context.Context, exec executor, device string) error
+	// check repairs the fs on the device before it is mounted
+	check(ctx context.Context, exec executor, device string) error
+	// grow grows the fs mounted at mountPoint from device to fill the device
+	grow(ctx context.Context, exec executor, device, mountPoint string) error
+	// stats returns usage of the fs mounted at mountPoint
+	stats(mountPoint string) (*fsStats, error)
+	// mountOptions returns options to mount the fs, besides flags specified by users
+	mountOptions(flags []string) []string
+}
+
+// fsStats is usage of a fs in bytes and inodes
+type fsStats struct {
+	total, available, used         int64
+	inodes, inodesFree, inodesUsed int64
+}
+
+var filesystems = make(map[string]filesystem)
+
+func registerFilesystem(fs filesystem) {
+	if _, ok := filesystems[fs.name()]; ok {
+		panic("filesystem " + fs.name() + " is registered twice")
+	}
+	filesystems[fs.name()] = fs
+}
+
+// supportedFsTypes returns sorted names of registered filesystems
+func supportedFsTypes() []string {
+	names := make([]string, 0, len(filesystems))
+	for name := range filesystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupFilesystem returns the filesystem of fsType, or an InvalidArgument error if it is not supported
+func lookupFilesystem(fsType string) (filesystem, error) {
+	fs, ok := filesystems[fsType]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "fs type %s is not supported, should be one of %s", fsType, strings.Join(supportedFsTypes(), ", "))
+	}
+	return fs, nil
+}
+
+// fsTypeOf returns fs type of the mount capability, or the default one if not specified
+func fsTypeOf(mnt *csi.VolumeCapability_MountVolume) string {
+	if mnt.GetFsType() == "" {
+		return defaultFsType
+	}
+	return mnt.GetFsType()
+}
+
+// validateFsType checks fs types of mount capabilities, block capabilities are always valid
+func validateFsType(caps ...*csi.VolumeCapability) error {
+	for _, cap := range caps {
+		if cap.GetMount() == nil {
+			continue
+		}
+		if _, e := lookupFilesystem(fsTypeOf(cap.GetMount())); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// statfs returns usage of the fs mounted at path
+func statfs(path string) (*fsStats, error) {
+	var st unix.Statfs_t
+	if e := unix.Statfs(path, &st); e != nil {
+		return nil, e
+	}
+	bsize := int64(st.Bsize)
+	return &fsStats{
+		total:      int64(st.Blocks) * bsize,
+		available:  int64(st.Bavail) * bsize,
+		used:       int64(st.Blocks-st.Bfree) * bsize,
+		inodes:     int64(st.Files),
+		inodesFree: int64(st.Ffree),
+		inodesUsed: int64(st.Files - st.Ffree),
+	}, nil
+}
+
+// executor runs commands on the node
+type executor interface {
+	run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+type osExecutor struct{}
+
+func (osExecutor) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return runCommand(ctx, name, args...)
+}
+
+// exitCode returns the exit code of a command, or -1 if it is not run at all
+func exitCode(e error) int {
+	if e == nil {
+		return 0
+	}
+	var exit interface{ ExitCode() int }
+	if errors.As(e, &exit) {
+		return exit.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,46 @@
+package ebs
+
+import (
+	"context"
+)
+
+func init() {
+	registerFilesystem(btrfsFS{})
+}
+
+// btrfsFS is btrfs, by btrfs-progs
+type btrfsFS struct{}
+
+func (btrfsFS) name() string {
+	return "btrfs"
+}
+
+func (btrfsFS) format(ctx context.Context, exec executor, device string) error {
+	_, e := exec.run(ctx, "mkfs.btrfs", device)
+	return e
+}
+
+// check does nothing, btrfs verifies checksums on reading, and btrfs check is for broken ones only
+func (btrfsFS) check(ctx context.Context, exec executor, device string) error {
+	return nil
+}
+
+// grow grows btrfs online by the mount point
+func (btrfsFS) grow(ctx context.Context, exec executor, device, mountPoint string) error {
+	_, e := exec.run(ctx, "btrfs", "filesystem", "resize", "max", mountPoint)
+	return e
+}
+
+// stats reports no inodes, they are allocated dynamically by btrfs
+func (btrfsFS) stats(mountPoint string) (*fsStats, error) {
+	st, e := statfs(mountPoint)
+	if e != nil {
+		return nil, e
+	}
+	st.inodes, st.inodesFree, st.inodesUsed = 0, 0, 0
+	return st, nil
+}
+
+func (btrfsFS) mountOptions(flags []string) []string {
+	return append([]string{}, flags...)
+}
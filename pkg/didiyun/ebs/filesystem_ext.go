@@ -0,0 +1,56 @@
+package ebs
+
+import (
+	"context"
+	"fmt"
+)
+
+func init() {
+	registerFilesystem(extFS{typ: "ext3"})
+	registerFilesystem(extFS{typ: "ext4"})
+}
+
+// extFS is ext3 or ext4, by e2fsprogs
+type extFS struct {
+	typ string
+}
+
+func (fs extFS) name() string {
+	return fs.typ
+}
+
+func (fs extFS) format(ctx context.Context, exec executor, device string) error {
+	// no blocks are reserved for root, volumes are not system disks
+	_, e := exec.run(ctx, "mkfs."+fs.typ, "-F", "-m0", device)
+	return e
+}
+
+func (fs extFS) check(ctx context.Context, exec executor, device string) error {
+	out, e := exec.run(ctx, "fsck", "-a", device)
+	switch code := exitCode(e); code {
+	case 0:
+		return nil
+	case 1:
+		logger(ctx).Infof("errors of %s on %s are corrected by fsck: %s", fs.typ, device, out)
+		return nil
+	case 4:
+		return fmt.Errorf("errors of %s on %s are left uncorrected by fsck, to be fixed manually: %s", fs.typ, device, out)
+	default:
+		// mounting tells whether the fs is broken
+		logger(ctx).Warningf("fsck %s on %s exited with %d, ignored: %s", fs.typ, device, code, out)
+		return nil
+	}
+}
+
+func (fs extFS) grow(ctx context.Context, exec executor, device, mountPoint string) error {
+	_, e := exec.run(ctx, "resize2fs", device)
+	return e
+}
+
+func (fs extFS) stats(mountPoint string) (*fsStats, error) {
+	return statfs(mountPoint)
+}
+
+func (fs extFS) mountOptions(flags []string) []string {
+	return append([]string{}, flags...)
+}
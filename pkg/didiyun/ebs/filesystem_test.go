@@ -0,0 +1,195 @@
+package ebs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+type fakeReply struct {
+	out  string
+	code int
+}
+
+type fakeExitError int
+
+func (e fakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e fakeExitError) ExitCode() int {
+	return int(e)
+}
+
+// fakeExec records commands run, and replies by command lines, commands not replied succeed without output
+type fakeExec struct {
+	mu      sync.Mutex
+	cmds    []string
+	replies map[string]fakeReply
+}
+
+func newFakeExec() *fakeExec {
+	return &fakeExec{replies: make(map[string]fakeReply)}
+}
+
+func (f *fakeExec) reply(cmd, out string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies[cmd] = fakeReply{out: out, code: code}
+}
+
+func (f *fakeExec) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	f.cmds = append(f.cmds, cmd)
+	reply := f.replies[cmd]
+	if reply.code != 0 {
+		return []byte(reply.out), fakeExitError(reply.code)
+	}
+	return []byte(reply.out), nil
+}
+
+func (f *fakeExec) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmds := f.cmds
+	f.cmds = nil
+	return cmds
+}
+
+func TestFsType(t *testing.T) {
+	mount := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}}}
+	}
+	block := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+
+	assert.Equal(t, []string{"btrfs", "ext3", "ext4", "xfs"}, supportedFsTypes())
+	assert.Equal(t, "ext4", fsTypeOf(mount("").GetMount()))
+	assert.Equal(t, "xfs", fsTypeOf(mount("xfs").GetMount()))
+	assert.NoError(t, validateFsType(mount(""), mount("ext3"), mount("xfs"), mount("btrfs"), block, nil))
+	assert.Equal(t, codes.InvalidArgument, status.Code(validateFsType(mount("ext4"), mount("vfat"))))
+}
+
+func TestFilesystems(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		fsType  string
+		format  string
+		check   []string
+		grow    string
+		options []string
+	}{
+		{fsType: "ext3", format: "mkfs.ext3 -F -m0 /dev/vdb", check: []string{"fsck -a /dev/vdb"}, grow: "resize2fs /dev/vdb", options: []string{"noatime"}},
+		{fsType: "ext4", format: "mkfs.ext4 -F -m0 /dev/vdb", check: []string{"fsck -a /dev/vdb"}, grow: "resize2fs /dev/vdb", options: []string{"noatime"}},
+		{fsType: "xfs", format: "mkfs.xfs /dev/vdb", grow: "xfs_growfs /mnt/vdb", options: []string{"noatime", "nouuid"}},
+		{fsType: "btrfs", format: "mkfs.btrfs /dev/vdb", grow: "btrfs filesystem resize max /mnt/vdb", options: []string{"noatime"}},
+	} {
+		t.Run(c.fsType, func(t *testing.T) {
+			fs, e := lookupFilesystem(c.fsType)
+			require.NoError(t, e)
+			assert.Equal(t, c.fsType, fs.name())
+			exec := newFakeExec()
+
+			require.NoError(t, fs.format(ctx, exec, "/dev/vdb"))
+			assert.Equal(t, []string{c.format}, exec.commands())
+			require.NoError(t, fs.check(ctx, exec, "/dev/vdb"))
+			assert.Equal(t, c.check, exec.commands())
+			require.NoError(t, fs.grow(ctx, exec, "/dev/vdb", "/mnt/vdb"))
+			assert.Equal(t, []string{c.grow}, exec.commands())
+
+			flags := []string{"noatime"}
+			assert.Equal(t, c.options, fs.mountOptions(flags))
+			assert.Equal(t, []string{"noatime"}, flags, "flags of users are not modified")
+
+			st, e := fs.stats(t.TempDir())
+			require.NoError(t, e)
+			assert.True(t, st.total > 0 && st.available <= st.total && st.used <= st.total)
+			_, e = fs.stats("/not/exist")
+			assert.Error(t, e)
+		})
+	}
+
+	exec := newFakeExec()
+	exec.reply("mkfs.xfs /dev/vdb", "mkfs failed", 1)
+	assert.Error(t, filesystems["xfs"].format(ctx, exec, "/dev/vdb"))
+	assert.Equal(t, []string{"nouuid"}, filesystems["xfs"].mountOptions([]string{"nouuid"}))
+}
+
+func TestExtCheck(t *testing.T) {
+	ctx := context.Background()
+	exec := newFakeExec()
+	ext4 := filesystems["ext4"]
+	for code, ok := range map[int]bool{0: true, 1: true, 4: false, 8: true} {
+		exec.reply("fsck -a /dev/vdb", "", code)
+		e := ext4.check(ctx, exec, "/dev/vdb")
+		assert.Equal(t, ok, e == nil, "exit code %d", code)
+	}
+}
+
+func TestFormatAndMount(t *testing.T) {
+	ctx := context.Background()
+	exec := newFakeExec()
+	mounter := &mount.FakeMounter{}
+	ns := &nodeServer{mounter: mounter, exec: exec}
+	blkid := "blkid -p -s TYPE -s PTTYPE -o export /dev/vdb"
+
+	// blank device
+	exec.reply(blkid, "", 2)
+	require.NoError(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/a", "xfs", nil))
+	assert.Equal(t, []string{blkid, "mkfs.xfs /dev/vdb"}, exec.commands())
+	if assert.Len(t, mounter.MountPoints, 1) {
+		assert.Equal(t, mount.MountPoint{Device: "/dev/vdb", Path: "/mnt/a", Type: "xfs", Opts: []string{"nouuid", "defaults"}}, mounter.MountPoints[0])
+	}
+
+	// blank device is never formatted to be read only
+	e := ns.formatAndMount(ctx, "/dev/vdb", "/mnt/a", "xfs", []string{"ro"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(e))
+	assert.Equal(t, []string{blkid}, exec.commands())
+	assert.Len(t, mounter.MountPoints, 1)
+
+	// formatted as requested
+	exec.reply(blkid, "DEVNAME=/dev/vdb\nTYPE=ext4\n", 0)
+	require.NoError(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/b", "ext4", nil))
+	assert.Equal(t, []string{blkid, "fsck -a /dev/vdb"}, exec.commands())
+	require.NoError(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/c", "ext4", []string{"ro"}))
+	assert.Equal(t, []string{blkid}, exec.commands(), "read only fs is not checked")
+	assert.Len(t, mounter.MountPoints, 3)
+
+	// never formatted again
+	assert.Error(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/d", "xfs", nil))
+	exec.reply(blkid, "DEVNAME=/dev/vdb\nPTTYPE=gpt\n", 0)
+	assert.Error(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/d", "ext4", nil))
+	exec.reply(blkid, "", 4)
+	assert.Error(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/d", "ext4", nil))
+	assert.Error(t, ns.formatAndMount(ctx, "/dev/vdb", "/mnt/d", "vfat", nil))
+	assert.Len(t, mounter.MountPoints, 3)
+}
+
+func TestResizeFS(t *testing.T) {
+	ctx := context.Background()
+	exec := newFakeExec()
+	ns := &nodeServer{exec: exec}
+
+	exec.reply("findmnt -J /mnt/a", `{"filesystems": [{"target": "/mnt/a", "source": "/dev/vdb", "fstype": "xfs", "options": "rw"}]}`, 0)
+	require.NoError(t, ns.resizeFS(ctx, "/mnt/a"))
+	assert.Equal(t, []string{"findmnt -J /mnt/a", "xfs_growfs /mnt/a"}, exec.commands())
+
+	exec.reply("findmnt -J /mnt/a", `{"filesystems": [{"target": "/mnt/a", "source": "/dev/vdb", "fstype": "ext4", "options": "rw"}]}`, 0)
+	require.NoError(t, ns.resizeFS(ctx, "/mnt/a"))
+	assert.Equal(t, []string{"findmnt -J /mnt/a", "resize2fs /dev/vdb"}, exec.commands())
+
+	exec.reply("findmnt -J /mnt/a", `{"filesystems": [{"target": "/mnt/a", "source": "/dev/vdb", "fstype": "vfat", "options": "rw"}]}`, 0)
+	assert.Error(t, ns.resizeFS(ctx, "/mnt/a"))
+	exec.reply("findmnt -J /mnt/a", "", 1)
+	assert.Error(t, ns.resizeFS(ctx, "/mnt/a"))
+}
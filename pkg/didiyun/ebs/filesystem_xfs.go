@@ -0,0 +1,46 @@
+package ebs
+
+import (
+	"context"
+)
+
+func init() {
+	registerFilesystem(xfsFS{})
+}
+
+// xfsFS is xfs, by xfsprogs
+type xfsFS struct{}
+
+func (xfsFS) name() string {
+	return "xfs"
+}
+
+func (xfsFS) format(ctx context.Context, exec executor, device string) error {
+	_, e := exec.run(ctx, "mkfs.xfs", device)
+	return e
+}
+
+// check does nothing, xfs replays its log on mounting, and xfs_repair is for broken ones only
+func (xfsFS) check(ctx context.Context, exec executor, device string) error {
+	return nil
+}
+
+// grow grows xfs online by the mount point
+func (xfsFS) grow(ctx context.Context, exec executor, device, mountPoint string) error {
+	_, e := exec.run(ctx, "xfs_growfs", mountPoint)
+	return e
+}
+
+func (xfsFS) stats(mountPoint string) (*fsStats, error) {
+	return statfs(mountPoint)
+}
+
+func (xfsFS) mountOptions(flags []string) []string {
+	options := append([]string{}, flags...)
+	// volumes cloned or restored from snapshots share the uuid of the source,
+	// and xfs refuses to mount them on the same node without nouuid
+	if !hasOption(options, "nouuid") {
+		options = append(options, "nouuid")
+	}
+	return options
+}
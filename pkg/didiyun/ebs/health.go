@@ -0,0 +1,74 @@
+package ebs
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+const (
+	defaultHealthCheckInterval = time.Minute
+	healthCheckTimeout         = 10 * time.Second
+)
+
+// healthChecker checks the connectivity and credentials of didiyun,
+// results are cached for the interval, so that frequent probes do not flood the api
+type healthChecker struct {
+	check    func(ctx context.Context) error
+	interval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newHealthChecker(check func(ctx context.Context) error, interval time.Duration) *healthChecker {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	return &healthChecker{check: check, interval: interval}
+}
+
+func (t *healthChecker) setInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	t.mu.Lock()
+	t.interval = interval
+	t.mu.Unlock()
+}
+
+// healthy returns nil if the last check in the interval succeeded, or checks again if the result is expired
+func (t *healthChecker) healthy(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.checked.IsZero() && time.Since(t.checked) < t.interval {
+		return t.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if e := t.check(ctx); e != nil {
+		t.err = fmt.Errorf("didiyun is not accessible: %w", e)
+		klog.Errorf("health check failed: %s", e)
+	} else {
+		t.err = nil
+		klog.V(5).Info("health check passed")
+	}
+	t.checked = time.Now()
+	return t.err
+}
+
+func (t *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e := t.healthy(r.Context()); e != nil {
+		http.Error(w, e.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
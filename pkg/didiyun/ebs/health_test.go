@@ -0,0 +1,67 @@
+package ebs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var checks int
+	var result error
+	health := newHealthChecker(func(ctx context.Context) error {
+		checks++
+		return result
+	}, time.Hour)
+	ctx := context.Background()
+
+	assert.NoError(t, health.healthy(ctx))
+	assert.NoError(t, health.healthy(ctx))
+	assert.Equal(t, 1, checks, "results are cached")
+
+	result = errors.New("invalid token")
+	health.checked = time.Now().Add(-2 * time.Hour)
+	assert.Error(t, health.healthy(ctx), "checked again after expired")
+	assert.Equal(t, 2, checks)
+
+	w := httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid token")
+
+	result = nil
+	health.checked = time.Time{}
+	w = httptest.NewRecorder()
+	health.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestIdentityServerProbe(t *testing.T) {
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	var result error
+	svr := NewIdentityServer(driver, newHealthChecker(func(ctx context.Context) error {
+		return result
+	}, time.Nanosecond))
+	ctx := context.Background()
+
+	resp, e := svr.Probe(ctx, &csi.ProbeRequest{})
+	if assert.NoError(t, e) {
+		assert.True(t, resp.GetReady().GetValue())
+	}
+
+	result = errors.New("connection refused")
+	time.Sleep(time.Millisecond)
+	_, e = svr.Probe(ctx, &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(e))
+}
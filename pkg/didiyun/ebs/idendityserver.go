@@ -4,18 +4,31 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	health *healthChecker
 }
 
-func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
+func NewIdentityServer(d *csicommon.CSIDriver, health *healthChecker) *identityServer {
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		health:                health,
 	}
 }
 
+// Probe reports the plugin is unhealthy if didiyun is not accessible with the configured token
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if e := ids.health.healthy(ctx); e != nil {
+		return nil, status.Error(codes.FailedPrecondition, e.Error())
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
@@ -0,0 +1,38 @@
+package ebs
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// volumeLocks tracks in-flight operations by volume ids, or other keys like volume names and target paths.
+// overlapped operations of the same key are aborted, and left for the CO to retry, as the csi spec recommends.
+// the zero value is ready to use.
+type volumeLocks struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// lock returns an Aborted error if an operation of key is already in progress
+func (t *volumeLocks) lock(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.keys[key]; ok {
+		klog.V(3).Infof("an operation of %s is already in progress", key)
+		return status.Errorf(codes.Aborted, "an operation of %s is already in progress", key)
+	}
+	if t.keys == nil {
+		t.keys = make(map[string]struct{})
+	}
+	t.keys[key] = struct{}{}
+	return nil
+}
+
+func (t *volumeLocks) unlock(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, key)
+}
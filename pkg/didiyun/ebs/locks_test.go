@@ -0,0 +1,166 @@
+package ebs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// blockingEbsClient blocks Get and Attach until released
+type blockingEbsClient struct {
+	didiyunClient.EbsClient
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingEbsClient(cli didiyunClient.EbsClient) *blockingEbsClient {
+	return &blockingEbsClient{EbsClient: cli, entered: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (t *blockingEbsClient) block() {
+	t.entered <- struct{}{}
+	<-t.release
+}
+
+func (t *blockingEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	t.block()
+	return t.EbsClient.Get(ctx, ebsUUID)
+}
+
+func (t *blockingEbsClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	t.block()
+	return t.EbsClient.Attach(ctx, ebsUUID, dc2Name)
+}
+
+func TestVolumeLocks(t *testing.T) {
+	var locks volumeLocks
+	require.NoError(t, locks.lock("vol-1"))
+	assert.Equal(t, codes.Aborted, status.Code(locks.lock("vol-1")))
+	assert.NoError(t, locks.lock("vol-2"))
+	locks.unlock("vol-1")
+	assert.NoError(t, locks.lock("vol-1"))
+}
+
+func TestControllerServerConcurrentPublish(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	ctx := context.Background()
+	ebsCli := c.Ebs()
+	volID, e := ebsCli.Create(ctx, "", "zone1", "test-vol", "", 10)
+	require.NoError(t, e)
+
+	cli := newBlockingEbsClient(ebsCli)
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{}, cli, newMockCloudClient())
+	req := &csi.ControllerPublishVolumeRequest{VolumeId: volID, NodeId: "test-node"}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, e := svr.ControllerPublishVolume(ctx, req)
+		assert.NoError(t, e)
+	}()
+	<-cli.entered
+
+	// overlapped operations of the same volume are aborted
+	var aborted sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		aborted.Add(1)
+		go func() {
+			defer aborted.Done()
+			_, e := svr.ControllerPublishVolume(ctx, req)
+			assert.Equal(t, codes.Aborted, status.Code(e))
+			_, e = svr.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volID})
+			assert.Equal(t, codes.Aborted, status.Code(e))
+		}()
+	}
+	aborted.Wait()
+
+	close(cli.release)
+	wg.Wait()
+
+	// retried after the first one is done
+	_, e = svr.ControllerPublishVolume(ctx, req)
+	assert.NoError(t, e)
+}
+
+func TestNodeServerConcurrentStage(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	nodeID := "test-node"
+	ctx := context.Background()
+	ebsCli := c.Ebs()
+	volID, e := ebsCli.Create(ctx, "", "zone1", "test-vol", "", 10)
+	require.NoError(t, e)
+	device, e := ebsCli.Attach(ctx, volID, nodeID)
+	require.NoError(t, e)
+
+	cli := newBlockingEbsClient(ebsCli)
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, nodeID)
+	require.NotNil(t, driver)
+	svr := &nodeServer{
+		nodeID:            nodeID,
+		zone:              "zone1",
+		mounter:           &mount.FakeMounter{},
+		exec:              newFakeExec(),
+		devices:           newFakeDevices(t),
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(driver),
+		ebsCli:            cli,
+	}
+	plugDisk(t, svr.devices, device, virtioSerial(volID), true)
+
+	tmp, e := ioutil.TempDir("", "ebs_locks_test-")
+	require.NoError(t, e)
+	defer func() {
+		_ = os.RemoveAll(tmp)
+	}()
+	stagePath := filepath.Join(tmp, "stage")
+	require.NoError(t, os.MkdirAll(stagePath, 0755))
+	targetPath := filepath.Join(tmp, "target")
+	require.NoError(t, os.MkdirAll(targetPath, 0755))
+
+	// no publish context, the device is got from didiyun
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          volID,
+		StagingTargetPath: stagePath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, e := svr.NodeStageVolume(ctx, req)
+		assert.NoError(t, e)
+	}()
+	<-cli.entered
+
+	_, e = svr.NodeStageVolume(ctx, req)
+	assert.Equal(t, codes.Aborted, status.Code(e))
+	_, e = svr.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: stagePath})
+	assert.Equal(t, codes.Aborted, status.Code(e))
+	// publishing is locked by target paths
+	_, e = svr.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: targetPath})
+	assert.NoError(t, e)
+
+	close(cli.release)
+	wg.Wait()
+
+	_, e = svr.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: stagePath})
+	assert.NoError(t, e)
+}
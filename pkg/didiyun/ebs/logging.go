@@ -0,0 +1,118 @@
+package ebs
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	return uuid.NewRandom().String()[:8]
+}
+
+// requestLogger writes log lines prefixed by the request id, to correlate lines of the same request
+type requestLogger struct {
+	prefix string
+}
+
+// logger returns a logger of the request in ctx
+func logger(ctx context.Context) requestLogger {
+	if id := requestID(ctx); id != "" {
+		return requestLogger{prefix: "[" + id + "] "}
+	}
+	return requestLogger{}
+}
+
+func (l requestLogger) Infof(format string, args ...interface{}) {
+	klog.InfoDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l requestLogger) Warningf(format string, args ...interface{}) {
+	klog.WarningDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	klog.ErrorDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l requestLogger) V(level klog.Level) verboseLogger {
+	return verboseLogger{enabled: bool(klog.V(level)), prefix: l.prefix}
+}
+
+type verboseLogger struct {
+	enabled bool
+	prefix  string
+}
+
+func (l verboseLogger) Info(args ...interface{}) {
+	if l.enabled {
+		klog.InfoDepth(1, l.prefix+fmt.Sprint(args...))
+	}
+}
+
+func (l verboseLogger) Infof(format string, args ...interface{}) {
+	if l.enabled {
+		klog.InfoDepth(1, l.prefix+fmt.Sprintf(format, args...))
+	}
+}
+
+// loggingInterceptor assigns an id to each request, and logs the method, volume, duration and status code of it.
+// secrets in requests and responses are stripped.
+func loggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := newRequestID()
+	ctx = withRequestID(ctx, id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("csi.request_id", id))
+	log := logger(ctx)
+	method := path.Base(info.FullMethod)
+	volume := requestVolume(req)
+
+	log.V(3).Infof("%s started, volume %q", method, volume)
+	log.V(5).Infof("%s request: %s", method, protosanitizer.StripSecrets(req))
+	start := time.Now()
+	resp, e := handler(ctx, req)
+	elapsed := time.Since(start)
+
+	if e != nil {
+		log.Errorf("%s failed in %s, volume %q, code %s: %s", method, elapsed, volume, status.Code(e), status.Convert(e).Message())
+	} else {
+		log.V(3).Infof("%s succeeded in %s, volume %q", method, elapsed, volume)
+		log.V(5).Infof("%s response: %s", method, protosanitizer.StripSecrets(resp))
+	}
+	return resp, e
+}
+
+// requestVolume returns the volume id, or the name for creating, or the snapshot id of the request
+func requestVolume(req interface{}) string {
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		return r.GetName()
+	case interface{ GetVolumeId() string }:
+		return r.GetVolumeId()
+	case interface{ GetSourceVolumeId() string }:
+		return r.GetSourceVolumeId()
+	case interface{ GetSnapshotId() string }:
+		return r.GetSnapshotId()
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package ebs
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+func TestLoggingInterceptor(t *testing.T) {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	require.NoError(t, flags.Set("logtostderr", "false"))
+	require.NoError(t, flags.Set("v", "5"))
+	var buf bytes.Buffer
+	klog.SetOutput(&buf)
+	defer func() {
+		_ = flags.Set("logtostderr", "true")
+		_ = flags.Set("v", "0")
+	}()
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "vol-1",
+		Secrets:  map[string]string{"token": "top-secret"},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	var id string
+	_, e := loggingInterceptor(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		id = requestID(ctx)
+		logger(ctx).V(4).Infof("staging in handler")
+		return nil, status.Error(codes.Aborted, "in progress")
+	})
+	assert.Equal(t, codes.Aborted, status.Code(e))
+	klog.Flush()
+
+	require.NotEmpty(t, id)
+	out := buf.String()
+	assert.Contains(t, out, "["+id+"] staging in handler", "request id is propagated to the handler")
+	assert.Contains(t, out, "["+id+"] NodeStageVolume failed in")
+	assert.Contains(t, out, `volume "vol-1", code Aborted`)
+	assert.NotContains(t, out, "top-secret")
+}
+
+func TestRequestVolume(t *testing.T) {
+	assert.Equal(t, "pvc-1", requestVolume(&csi.CreateVolumeRequest{Name: "pvc-1"}))
+	assert.Equal(t, "vol-1", requestVolume(&csi.ControllerPublishVolumeRequest{VolumeId: "vol-1"}))
+	assert.Equal(t, "vol-1", requestVolume(&csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: "vol-1"}))
+	assert.Equal(t, "snap-1", requestVolume(&csi.DeleteSnapshotRequest{SnapshotId: "snap-1"}))
+	assert.Empty(t, requestVolume(&csi.GetCapacityRequest{}))
+}
@@ -0,0 +1,192 @@
+package ebs
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "csi_didiyun_ebs"
+
+var (
+	csiOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "csi",
+		Name:      "operations_total",
+		Help:      "Total number of csi rpc, by method and status code.",
+	}, []string{"method", "code"})
+	csiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "csi",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of csi rpc, by method and status code.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"method", "code"})
+
+	ebsOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ebs",
+		Name:      "operations_total",
+		Help:      "Total number of ebs api calls, by operation and outcome.",
+	}, []string{"operation", "outcome"})
+	ebsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ebs",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of ebs api calls except attaching and detaching, by operation and outcome.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"operation", "outcome"})
+	// attaching and detaching wait for the jobs in didiyun to finish, which take much longer than others
+	ebsAttachmentDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ebs",
+		Name:      "attachment_wait_duration_seconds",
+		Help:      "Duration of attaching and detaching ebs, including waiting for the jobs to finish, by operation and outcome.",
+		Buckets:   []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600},
+	}, []string{"operation", "outcome"})
+
+	metricsRegistry = prometheus.NewRegistry()
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		csiOperations, csiDuration,
+		ebsOperations, ebsDuration, ebsAttachmentDuration,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricsInterceptor records counts and durations of csi rpc
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, e := handler(ctx, req)
+
+	method := path.Base(info.FullMethod)
+	code := status.Code(e).String()
+	csiOperations.WithLabelValues(method, code).Inc()
+	csiDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	return resp, e
+}
+
+// metricsEbsClient records counts and durations of ebs api calls
+type metricsEbsClient struct {
+	cli didiyunClient.EbsClient
+}
+
+var _ didiyunClient.EbsClient = (*metricsEbsClient)(nil)
+
+func newMetricsEbsClient(cli didiyunClient.EbsClient) *metricsEbsClient {
+	return &metricsEbsClient{cli: cli}
+}
+
+func observeEbs(op string, start time.Time, e error) {
+	outcome := errorCode(e).String()
+	ebsOperations.WithLabelValues(op, outcome).Inc()
+	if op == opAttach || op == opDetach {
+		ebsAttachmentDuration.WithLabelValues(op, outcome).Observe(time.Since(start).Seconds())
+	} else {
+		ebsDuration.WithLabelValues(op, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (t *metricsEbsClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	start := time.Now()
+	id, e := t.cli.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+	observeEbs(opCreate, start, e)
+	return id, e
+}
+
+func (t *metricsEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	start := time.Now()
+	info, e := t.cli.Get(ctx, ebsUUID)
+	observeEbs(opGet, start, e)
+	return info, e
+}
+
+func (t *metricsEbsClient) Delete(ctx context.Context, ebsUUID string) error {
+	start := time.Now()
+	e := t.cli.Delete(ctx, ebsUUID)
+	observeEbs(opDelete, start, e)
+	return e
+}
+
+func (t *metricsEbsClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	start := time.Now()
+	device, e := t.cli.Attach(ctx, ebsUUID, dc2Name)
+	observeEbs(opAttach, start, e)
+	return device, e
+}
+
+func (t *metricsEbsClient) Detach(ctx context.Context, ebsUUID string) error {
+	start := time.Now()
+	e := t.cli.Detach(ctx, ebsUUID)
+	observeEbs(opDetach, start, e)
+	return e
+}
+
+func (t *metricsEbsClient) Expand(ctx context.Context, ebsUUID string, sizeGB int64) error {
+	start := time.Now()
+	e := t.cli.Expand(ctx, ebsUUID, sizeGB)
+	observeEbs(opExpand, start, e)
+	return e
+}
+
+// metricsCloudClient records counts and durations of didiyun api calls not covered by didiyunClient.EbsClient
+type metricsCloudClient struct {
+	cli cloudClient
+}
+
+var _ cloudClient = (*metricsCloudClient)(nil)
+
+func newMetricsCloudClient(cli cloudClient) *metricsCloudClient {
+	return &metricsCloudClient{cli: cli}
+}
+
+func (t *metricsCloudClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	begin := time.Now()
+	infos, e := t.cli.ListEbs(ctx, regionID, zoneID, start, limit)
+	observeEbs(opList, begin, e)
+	return infos, e
+}
+
+func (t *metricsCloudClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	start := time.Now()
+	id, e := t.cli.CreateFromSnapshot(ctx, regionID, zoneID, name, typ, snapUUID, sizeGB)
+	observeEbs(opCreateFromSnapshot, start, e)
+	return id, e
+}
+
+func (t *metricsCloudClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	start := time.Now()
+	id, e := t.cli.CreateSnapshot(ctx, regionID, ebsUUID, name)
+	observeEbs(opCreateSnapshot, start, e)
+	return id, e
+}
+
+func (t *metricsCloudClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	begin := time.Now()
+	snaps, e := t.cli.ListSnapshots(ctx, regionID, ebsUUID, name, start, limit)
+	observeEbs(opListSnapshots, begin, e)
+	return snaps, e
+}
+
+func (t *metricsCloudClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	start := time.Now()
+	e := t.cli.DeleteSnapshot(ctx, regionID, snapUUID)
+	observeEbs(opDeleteSnapshot, start, e)
+	return e
+}
@@ -0,0 +1,82 @@
+package ebs
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsEbsClient(t *testing.T) {
+	c, e := didiyunClient.NewMock()
+	require.NoError(t, e)
+	cli := newMetricsEbsClient(c.Ebs())
+	ctx := context.Background()
+
+	created := testutil.ToFloat64(ebsOperations.WithLabelValues(opCreate, "OK"))
+	notFound := testutil.ToFloat64(ebsOperations.WithLabelValues(opGet, "NotFound"))
+	attachments := testutil.CollectAndCount(ebsAttachmentDuration)
+
+	id, e := cli.Create(ctx, "gz", "gz01", "pvc-metrics", "SSD", 20)
+	require.NoError(t, e)
+	_, e = cli.Get(ctx, "not-exist")
+	require.Error(t, e)
+	_, e = cli.Attach(ctx, id, "node-1")
+	require.NoError(t, e)
+	require.NoError(t, cli.Detach(ctx, id))
+
+	assert.Equal(t, created+1, testutil.ToFloat64(ebsOperations.WithLabelValues(opCreate, "OK")))
+	assert.Equal(t, notFound+1, testutil.ToFloat64(ebsOperations.WithLabelValues(opGet, "NotFound")))
+	assert.True(t, testutil.CollectAndCount(ebsAttachmentDuration) >= attachments+2, "attaching and detaching are observed separately")
+}
+
+func TestMetricsCloudClient(t *testing.T) {
+	mock := newMockCloudClient()
+	mock.addEbs("vol-1", "gz", "gz01", "pvc-1", "SSD", 20)
+	cli := newMetricsCloudClient(mock)
+	ctx := context.Background()
+
+	listed := testutil.ToFloat64(ebsOperations.WithLabelValues(opList, "OK"))
+	created := testutil.ToFloat64(ebsOperations.WithLabelValues(opCreateSnapshot, "OK"))
+	deleted := testutil.ToFloat64(ebsOperations.WithLabelValues(opDeleteSnapshot, "NotFound"))
+
+	_, e := cli.ListEbs(ctx, "gz", "", 0, 10)
+	require.NoError(t, e)
+	_, e = cli.CreateSnapshot(ctx, "gz", "vol-1", "snap-1")
+	require.NoError(t, e)
+	require.Error(t, cli.DeleteSnapshot(ctx, "gz", "not-exist"))
+
+	assert.Equal(t, listed+1, testutil.ToFloat64(ebsOperations.WithLabelValues(opList, "OK")))
+	assert.Equal(t, created+1, testutil.ToFloat64(ebsOperations.WithLabelValues(opCreateSnapshot, "OK")))
+	assert.Equal(t, deleted+1, testutil.ToFloat64(ebsOperations.WithLabelValues(opDeleteSnapshot, "NotFound")))
+}
+
+func TestMetricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	ok := testutil.ToFloat64(csiOperations.WithLabelValues("CreateVolume", "OK"))
+	aborted := testutil.ToFloat64(csiOperations.WithLabelValues("CreateVolume", "Aborted"))
+
+	_, e := metricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	require.NoError(t, e)
+	_, e = metricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Aborted, "in progress")
+	})
+	require.Error(t, e)
+
+	assert.Equal(t, ok+1, testutil.ToFloat64(csiOperations.WithLabelValues("CreateVolume", "OK")))
+	assert.Equal(t, aborted+1, testutil.ToFloat64(csiOperations.WithLabelValues("CreateVolume", "Aborted")))
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.Contains(w.Body.String(), `csi_didiyun_ebs_csi_operations_total{code="Aborted",method="CreateVolume"}`))
+}
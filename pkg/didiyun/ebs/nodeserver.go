@@ -4,24 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
-const (
-	// might be overwritten by environment variable `MAX_VOLUMES_PER_NODE`
-	defaultMaxVolumesPerNode = 5
-	maxVolumePerNodeEnvKey   = "MAX_VOLUMES_PER_NODE"
-)
+const defaultMaxVolumesPerNode = 5
 
 type nodeServer struct {
 	nodeID            string
@@ -29,29 +26,32 @@ type nodeServer struct {
 	region            string
 	zone              string
 	maxVolumesPerNode int64
+	checkDevice       bool
 	*csicommon.DefaultNodeServer
 	mounter mount.Interface
+	exec    executor
+	devices *deviceResolver
 	ebsCli  didiyunClient.EbsClient
+	locks   volumeLocks
 }
 
-func NewNodeServer(d *csicommon.CSIDriver, nodeID, nodeIP, region, zone string, cli didiyunClient.EbsClient) *nodeServer {
-	var maxVolumesPerNode int64 = defaultMaxVolumesPerNode
-	if val, e := strconv.ParseInt(os.Getenv(maxVolumePerNodeEnvKey), 10, 64); e != nil {
-		klog.V(2).Infof("parse env var %s failed: %v", maxVolumePerNodeEnvKey, e)
-	} else if val <= 0 {
-		klog.V(2).Infof("invalid env var %s value: %d", maxVolumePerNodeEnvKey, val)
-	} else {
-		maxVolumesPerNode = val
+func NewNodeServer(d *csicommon.CSIDriver, cfg *DriverConfig, cli didiyunClient.EbsClient) *nodeServer {
+	maxVolumesPerNode := cfg.MaxVolumesPerNode
+	if maxVolumesPerNode <= 0 {
+		maxVolumesPerNode = defaultMaxVolumesPerNode
 	}
 
 	return &nodeServer{
-		nodeID:            nodeID,
-		nodeIP:            nodeIP,
-		region:            region,
-		zone:              zone,
+		nodeID:            cfg.NodeID,
+		nodeIP:            cfg.NodeIP,
+		region:            cfg.RegionID,
+		zone:              cfg.ZoneID,
 		maxVolumesPerNode: maxVolumesPerNode,
+		checkDevice:       cfg.CheckDevice,
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 		mounter:           mount.New(""),
+		exec:              osExecutor{},
+		devices:           newDeviceResolver(),
 		ebsCli:            cli,
 	}
 }
@@ -59,32 +59,35 @@ func NewNodeServer(d *csicommon.CSIDriver, nodeID, nodeIP, region, zone string,
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	sourcePath := req.StagingTargetPath
 	targetPath := req.GetTargetPath()
-	isBlock := req.GetVolumeCapability().GetBlock() != nil
-	if isBlock {
-
-		if e := ns.mounter.Mount(sourcePath, targetPath, "ext4", []string{"bind"}); e != nil {
-			return nil, status.Error(codes.Internal, e.Error())
-		}
-		klog.V(4).Infof("mounted block volume %s (%s -> %s) with flags %v and fsType %s", req.VolumeId, sourcePath, targetPath, []string{"bind"}, "ext4")
-		return nil, status.Error(codes.Unimplemented, "")
-	}
-
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
 	}
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target Path cannot be emtpy")
 	}
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target Path cannot be empty")
+	}
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capability cannot be emtpy")
 	}
+	// a volume could be published to different target paths at the same time
+	lockKey := req.GetVolumeId() + ":" + targetPath
+	if e := ns.locks.lock(lockKey); e != nil {
+		return nil, e
+	}
+	defer ns.locks.unlock(lockKey)
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return ns.publishBlockVolume(ctx, req)
+	}
 
 	notmounted, e := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if e != nil {
 		return nil, status.Error(codes.Internal, e.Error())
 	}
 	if !notmounted {
-		klog.V(2).Infof("volume %s at path %s is already mounted", req.VolumeId, targetPath)
+		logger(ctx).V(2).Infof("volume %s at path %s is already mounted", req.VolumeId, targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
@@ -94,39 +97,94 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if req.Readonly {
 		options = append(options, "ro")
 	}
-	fsType := "ext4"
-	if mnt.FsType != "" {
-		fsType = mnt.FsType
-	}
+	fsType := fsTypeOf(mnt)
 
 	if e := ns.mounter.Mount(sourcePath, targetPath, fsType, options); e != nil {
 		return nil, status.Error(codes.Internal, e.Error())
 	}
 
-	klog.V(4).Infof("mounted volume %s (%s -> %s) with flags %v and fsType %s", req.VolumeId, sourcePath, targetPath, options, fsType)
+	logger(ctx).V(4).Infof("mounted volume %s (%s -> %s) with flags %v and fsType %s", req.VolumeId, sourcePath, targetPath, options, fsType)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishBlockVolume bind mounts the device onto the target file
+func (ns *nodeServer) publishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	device, e := ns.attachedDevice(ctx, req.GetVolumeId(), req.GetPublishContext())
+	if e != nil {
+		return nil, e
+	}
+	if e := makeFile(targetPath); e != nil {
+		return nil, status.Errorf(codes.Internal, "create target file %s error %s", targetPath, e)
+	}
+
+	notmounted, e := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if e != nil {
+		return nil, status.Error(codes.Internal, e.Error())
+	}
+	if !notmounted {
+		logger(ctx).V(2).Infof("block volume %s at path %s is already mounted", req.VolumeId, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.Readonly {
+		options = append(options, "ro")
+	}
+	if e := ns.mounter.Mount(device, targetPath, "", options); e != nil {
+		return nil, status.Error(codes.Internal, e.Error())
+	}
+
+	logger(ctx).V(4).Infof("mounted block volume %s (%s -> %s) with flags %v", req.VolumeId, device, targetPath, options)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// makeFile creates the file and its parent directories if not existing
+func makeFile(path string) error {
+	if e := os.MkdirAll(filepath.Dir(path), 0750); e != nil {
+		return e
+	}
+	f, e := os.OpenFile(path, os.O_CREATE, 0640)
+	if e != nil {
+		return e
+	}
+	return f.Close()
+}
+
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	targetPath := req.GetTargetPath()
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
 	}
+	lockKey := req.GetVolumeId() + ":" + targetPath
+	if e := ns.locks.lock(lockKey); e != nil {
+		return nil, e
+	}
+	defer ns.locks.unlock(lockKey)
 
 	notmounted, e := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if os.IsNotExist(e) {
+		logger(ctx).V(2).Infof("volume %s at path %s is already cleaned up", req.VolumeId, targetPath)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
 	if e != nil {
 		return nil, status.Error(codes.Internal, e.Error())
 	}
 	if notmounted {
-		klog.V(2).Infof("volume %s at path %s is already unmounted", req.VolumeId, targetPath)
-		return &csi.NodeUnpublishVolumeResponse{}, nil
+		logger(ctx).V(2).Infof("volume %s at path %s is already unmounted", req.VolumeId, targetPath)
+	} else {
+		if e := ns.mounter.Unmount(targetPath); e != nil {
+			return nil, status.Error(codes.Internal, e.Error())
+		}
+		logger(ctx).V(4).Infof("unmounted volume %s from %s", req.VolumeId, targetPath)
 	}
 
-	if e := ns.mounter.Unmount(targetPath); e != nil {
-		return nil, status.Error(codes.Internal, e.Error())
+	// target files of block volumes are created by NodePublishVolume
+	if info, e := os.Stat(targetPath); e == nil && !info.IsDir() {
+		if e := os.Remove(targetPath); e != nil {
+			return nil, status.Errorf(codes.Internal, "remove target file %s error %s", targetPath, e)
+		}
 	}
-
-	klog.V(4).Infof("unmounted volume %s from %s", req.VolumeId, targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -141,79 +199,73 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capability is null")
 	}
+	if e := validateFsType(req.GetVolumeCapability()); e != nil {
+		return nil, e
+	}
+	ctx, e := withSecrets(ctx, req.GetSecrets())
+	if e != nil {
+		return nil, e
+	}
+	if e := ns.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer ns.locks.unlock(req.GetVolumeId())
 
 	notmounted, e := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if e != nil {
 		return nil, status.Error(codes.Internal, e.Error())
 	}
 	if !notmounted {
-		klog.V(2).Infof("volume %s at global path %s is already mounted", req.VolumeId, targetPath)
+		logger(ctx).V(2).Infof("volume %s at global path %s is already mounted", req.VolumeId, targetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	// check or attach
-	var device string
-
-	ebs, e := ns.ebsCli.Get(ctx, req.GetVolumeId())
+	device, e := ns.attachedDevice(ctx, req.GetVolumeId(), req.GetPublishContext())
 	if e != nil {
-		return nil, status.Error(codes.Internal, e.Error())
+		return nil, e
 	}
-	if ebs.GetDc2() != nil {
-		if ebs.GetDc2().GetIp() != ns.nodeIP {
-			msg := fmt.Sprintf("ebs %s (%s) is mounted to another node %s, could not be published to %s", ebs.GetName(), ebs.GetEbsUuid(), ebs.GetDc2().GetName(), ns.nodeID)
-			klog.Errorf(msg)
-			return nil, status.Error(codes.FailedPrecondition, msg)
-		}
-
-		device = ebs.GetDeviceName()
-		klog.V(4).Infof("ebs %s (%s) is already mounted to %s as %s", ebs.GetName(), ebs.GetEbsUuid(), ns.nodeID, device)
-
-	} else {
-		// attach before mount to global
-		var e error
-		device, e = ns.ebsCli.Attach(ctx, req.GetVolumeId(), ns.nodeIP)
-		if e != nil {
-			return nil, status.Error(codes.Internal, e.Error())
-		}
-		klog.V(4).Infof("ebs %s (%s) is mounted to %s as %s", ebs.GetName(), ebs.GetEbsUuid(), ns.nodeID, device)
-	}
-
-	isBlock := req.GetVolumeCapability().GetBlock() != nil
-	if isBlock {
-		diskMounter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: mount.NewOsExec()}
-		if err := diskMounter.FormatAndMount("/dev/"+device, targetPath, "ext4", []string{"bind"}); err != nil {
-			klog.Errorf("volume %s, Device: %s, FormatAndMount error: %s", req.GetVolumeId(), device, err)
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-		klog.V(4).Infof("block volume %s, target %s, device: %s", req.GetVolumeId(), targetPath, device)
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// block volumes are left untouched, and bind mounted by NodePublishVolume
+		logger(ctx).V(4).Infof("block volume %s, device: %s", req.GetVolumeId(), device)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	var err error
-	defer func() { // detach volume in case of any error, because NodeUnstageVolume won't be called
-		if err != nil {
-			if e := ns.ebsCli.Detach(ctx, req.GetVolumeId()); e != nil {
-				klog.Errorf("volume %s, Device: %s, detach error: %s", req.GetVolumeId(), device, e)
-			}
-		}
-	}()
-
 	// mount
 	mnt := req.VolumeCapability.GetMount()
-	fsType := "ext4"
-	if mnt.FsType != "" {
-		fsType = mnt.FsType
-	}
-	diskMounter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: mount.NewOsExec()}
-	if err = diskMounter.FormatAndMount("/dev/"+device, targetPath, fsType, mnt.MountFlags); err != nil {
-		klog.Errorf("volume %s, Device: %s, FormatAndMount error: %s", req.GetVolumeId(), device, err)
+	fsType := fsTypeOf(mnt)
+	if err := ns.formatAndMount(ctx, device, targetPath, fsType, mnt.MountFlags); err != nil {
+		logger(ctx).Errorf("volume %s, Device: %s, FormatAndMount error: %s", req.GetVolumeId(), device, err)
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	klog.V(4).Infof("staged volume %s, target %s, device: %s", req.GetVolumeId(), targetPath, device)
+	logger(ctx).V(4).Infof("staged volume %s, target %s, device: %s", req.GetVolumeId(), targetPath, device)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// attachedDevice returns path of the device the volume is attached as, found by its serial
+func (ns *nodeServer) attachedDevice(ctx context.Context, volumeID string, publishContext map[string]string) (string, error) {
+	// attached by ControllerPublishVolume
+	device := publishContext[keyDeviceName]
+	if device == "" {
+		// published before attaching is moved to the controller
+		ebs, e := ns.ebsCli.Get(ctx, volumeID)
+		if e != nil {
+			return "", toStatus(e)
+		}
+		if ebs.GetDc2().GetName() != ns.nodeID {
+			msg := fmt.Sprintf("ebs %s (%s) is not attached to %s", ebs.GetName(), ebs.GetEbsUuid(), ns.nodeID)
+			logger(ctx).Errorf("%s", msg)
+			return "", status.Error(codes.FailedPrecondition, msg)
+		}
+		device = ebs.GetDeviceName()
+	}
+	logger(ctx).V(4).Infof("volume %s is attached to %s as %s", volumeID, ns.nodeID, device)
+	return ns.devices.resolve(ctx, volumeID, device)
+}
+
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	targetPath := req.StagingTargetPath
 	if req.VolumeId == "" {
@@ -222,6 +274,10 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if targetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target Path can not be empty")
 	}
+	if e := ns.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer ns.locks.unlock(req.GetVolumeId())
 
 	notmounted, e := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if e != nil {
@@ -229,9 +285,9 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 	if !notmounted {
 		// check volume unattached before unmount for troubleshooting
-		if os.Getenv("ENABLE_CHECK_DEVICE") != "" && os.Getenv("ENABLE_CHECK_DEVICE") != "0" {
-			if e := checkDevice(targetPath); e != nil {
-				klog.Errorf("check device failed for path %s of volume %s before umount: %s", targetPath, req.VolumeId, e)
+		if ns.checkDevice {
+			if e := ns.checkDeviceOf(ctx, targetPath); e != nil {
+				logger(ctx).Errorf("check device failed for path %s of volume %s before umount: %s", targetPath, req.VolumeId, e)
 				return nil, status.Error(codes.Internal, "device not found before umount")
 			}
 		}
@@ -239,26 +295,24 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 			return nil, status.Error(codes.Internal, e.Error())
 		}
 	} else {
-		klog.V(2).Infof("volume %s is already umounted from global path %s", req.VolumeId, targetPath)
-	}
-
-	// detach after unmount from global
-	if e := ns.ebsCli.Detach(ctx, req.GetVolumeId()); e != nil {
-		return nil, status.Error(codes.Internal, e.Error())
+		logger(ctx).V(2).Infof("volume %s is already umounted from global path %s", req.VolumeId, targetPath)
 	}
 
+	// detached by ControllerUnpublishVolume
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	segments := map[string]string{
+		topologyZoneKey: ns.zone,
+	}
+	if ns.region != "" {
+		segments[topologyRegionKey] = ns.region
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId:            ns.nodeID,
-		MaxVolumesPerNode: ns.maxVolumesPerNode,
-		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				topologyZoneKey: ns.zone,
-			},
-		},
+		NodeId:             ns.nodeID,
+		MaxVolumesPerNode:  ns.maxVolumesPerNode,
+		AccessibleTopology: &csi.Topology{Segments: segments},
 	}, nil
 }
 
@@ -279,18 +333,209 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	if e := resizeFS(req.GetVolumePath()); e != nil {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if e := ns.locks.lock(req.GetVolumeId()); e != nil {
+		return nil, e
+	}
+	defer ns.locks.unlock(req.GetVolumeId())
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// nothing to grow on raw devices
+		logger(ctx).V(4).Infof("block volume %s needs no fs expansion", req.GetVolumeId())
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+	if e := validateFsType(req.GetVolumeCapability()); e != nil {
+		return nil, e
+	}
+	if e := ns.resizeFS(ctx, req.GetVolumePath()); e != nil {
 		return nil, status.Error(codes.Internal, e.Error())
 	}
-	klog.V(4).Infof("expanded volume %s, path: %s", req.GetVolumeId(), req.GetVolumePath())
+	logger(ctx).V(4).Infof("expanded volume %s, path: %s", req.GetVolumeId(), req.GetVolumePath())
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
+// NodeGetVolumeStats reports usage of bytes and inodes of fs volumes, or size of block volumes,
+// together with the condition of the volume
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume Path cannot be empty")
+	}
+	// no locks, stats are polled periodically, and should not abort other operations of the volume
+
+	info, e := os.Stat(req.GetVolumePath())
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.GetVolumePath())
+		}
+		return nil, status.Error(codes.Internal, e.Error())
+	}
+	notmounted, e := ns.mounter.IsLikelyNotMountPoint(req.GetVolumePath())
+	if e != nil {
+		return nil, status.Error(codes.Internal, e.Error())
+	}
+	if notmounted {
+		return abnormalVolume(ctx, "volume %s is not mounted at %s", req.GetVolumeId(), req.GetVolumePath()), nil
+	}
+
+	if !info.IsDir() {
+		return ns.blockVolumeStats(ctx, req.GetVolumeId(), req.GetVolumePath())
+	}
+	return ns.fsVolumeStats(ctx, req.GetVolumeId(), req.GetVolumePath())
+}
+
+func (ns *nodeServer) fsVolumeStats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	source, fsType, e := ns.findmnt(ctx, volumePath)
+	if e != nil {
+		return nil, status.Error(codes.Internal, e.Error())
+	}
+	if _, e := os.Stat(source); e != nil {
+		return abnormalVolume(ctx, "device %s of volume %s has disappeared: %s", source, volumeID, e), nil
+	}
+
+	stats := statfs
+	if fs, e := lookupFilesystem(fsType); e == nil {
+		stats = fs.stats
+	}
+	st, e := stats(volumePath)
+	if e != nil {
+		return nil, status.Error(codes.Internal, e.Error())
+	}
+	usage := []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     st.total,
+		Available: st.available,
+		Used:      st.used,
+	}}
+	// some filesystems allocate inodes dynamically, and have no limits
+	if st.inodes > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     st.inodes,
+			Available: st.inodesFree,
+			Used:      st.inodesUsed,
+		})
+	}
+	return &csi.NodeGetVolumeStatsResponse{Usage: usage, VolumeCondition: &csi.VolumeCondition{Message: "volume is healthy"}}, nil
+}
+
+func (ns *nodeServer) blockVolumeStats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	out, e := ns.exec.run(ctx, "blockdev", "--getsize64", volumePath)
+	if e != nil {
+		return abnormalVolume(ctx, "device of volume %s has disappeared: %s %s", volumeID, e, out), nil
+	}
+	size, e := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "invalid device size %q of volume %s", out, volumeID)
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: size}},
+		VolumeCondition: &csi.VolumeCondition{Message: "volume is healthy"},
+	}, nil
+}
+
+// abnormalVolume reports the volume condition without usage
+func abnormalVolume(ctx context.Context, format string, args ...interface{}) *csi.NodeGetVolumeStatsResponse {
+	msg := fmt.Sprintf(format, args...)
+	logger(ctx).Warningf("%s", msg)
+	return &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: msg}}
+}
+
+// formatAndMount formats the device if it is not formatted yet, or checks it otherwise, then mounts it to the target
+func (ns *nodeServer) formatAndMount(ctx context.Context, device, target, fsType string, flags []string) error {
+	ctx, span := startSpan(ctx, "FormatAndMount",
+		attribute.String("device", device),
+		attribute.String("target", target),
+		attribute.String("fs_type", fsType),
+	)
+	e := func() error {
+		fs, e := lookupFilesystem(fsType)
+		if e != nil {
+			return e
+		}
+		existing, e := ns.diskFormat(ctx, device)
+		if e != nil {
+			return e
+		}
+		switch existing {
+		case "":
+			// a read only fs is expected to have data, so a blank device is never formatted for it
+			if hasOption(flags, "ro") {
+				return status.Errorf(codes.FailedPrecondition, "%s is not formatted, but is mounted read only", device)
+			}
+			logger(ctx).Infof("formatting %s as %s", device, fsType)
+			if e := fs.format(ctx, ns.exec, device); e != nil {
+				return fmt.Errorf("format %s as %s error %w", device, fsType, e)
+			}
+		case fsType:
+			if !hasOption(flags, "ro") {
+				if e := fs.check(ctx, ns.exec, device); e != nil {
+					return e
+				}
+			}
+		default:
+			return fmt.Errorf("%s is formatted as %s, not %s", device, existing, fsType)
+		}
+		return ns.mounter.Mount(device, target, fsType, append(fs.mountOptions(flags), "defaults"))
+	}()
+	endSpan(span, e)
+	return e
+}
+
+// diskFormat returns fs type on the device, or empty if it is blank
+func (ns *nodeServer) diskFormat(ctx context.Context, device string) (string, error) {
+	out, e := ns.exec.run(ctx, "blkid", "-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", device)
+	if e != nil {
+		// nothing is recognized
+		if exitCode(e) == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("blkid %s error %w: %s", device, e, out)
+	}
+
+	var fsType, ptType string
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "TYPE":
+			fsType = kv[1]
+		case "PTTYPE":
+			ptType = kv[1]
+		}
+	}
+	if fsType == "" && ptType != "" {
+		// never format disks with data unknown
+		return "", fmt.Errorf("%s has a %s partition table, but no fs", device, ptType)
+	}
+	return fsType, nil
+}
+
 type findmntFS struct {
 	Filesystems []struct {
 		Target  string `json:"target"`
@@ -300,42 +545,42 @@ type findmntFS struct {
 	} `json:"filesystems"`
 }
 
-func resizeFS(mountPoint string) error {
-	out, e := exec.Command("findmnt", "-J", mountPoint).CombinedOutput()
+// findmnt returns source device and fs type mounted at mountPoint
+func (ns *nodeServer) findmnt(ctx context.Context, mountPoint string) (string, string, error) {
+	out, e := ns.exec.run(ctx, "findmnt", "-J", mountPoint)
 	if e != nil {
-		return e
+		return "", "", e
 	}
 	var fs findmntFS
 	if e := json.Unmarshal(out, &fs); e != nil {
-		return e
+		return "", "", e
 	}
 	if len(fs.Filesystems) != 1 {
-		return fmt.Errorf("invalid mount source number: %d", len(fs.Filesystems))
+		return "", "", fmt.Errorf("invalid mount source number: %d", len(fs.Filesystems))
 	}
+	return fs.Filesystems[0].Source, fs.Filesystems[0].Fstype, nil
+}
 
-	if fs.Filesystems[0].Fstype != "ext4" {
-		return fmt.Errorf("not supported fs type: %s", fs.Filesystems[0].Fstype)
+// resizeFS grows the fs mounted at mountPoint to fill the device
+func (ns *nodeServer) resizeFS(ctx context.Context, mountPoint string) error {
+	source, fsType, e := ns.findmnt(ctx, mountPoint)
+	if e != nil {
+		return e
 	}
-
-	if _, e = exec.Command("resize2fs", fs.Filesystems[0].Source).CombinedOutput(); e != nil {
+	fs, e := lookupFilesystem(fsType)
+	if e != nil {
 		return e
 	}
-	return nil
+	return fs.grow(ctx, ns.exec, source, mountPoint)
 }
 
-func checkDevice(mountPoint string) error {
-	out, e := exec.Command("findmnt", "-J", mountPoint).CombinedOutput()
+// checkDeviceOf checks the device mounted at mountPoint still exists
+func (ns *nodeServer) checkDeviceOf(ctx context.Context, mountPoint string) error {
+	source, _, e := ns.findmnt(ctx, mountPoint)
 	if e != nil {
 		return e
 	}
-	var fs findmntFS
-	if e := json.Unmarshal(out, &fs); e != nil {
-		return e
-	}
-	if len(fs.Filesystems) != 1 {
-		return fmt.Errorf("invalid mount source number: %d", len(fs.Filesystems))
-	}
-	if _, e := os.Stat(fs.Filesystems[0].Source); e != nil {
+	if _, e := os.Stat(source); e != nil {
 		return e
 	}
 	return nil
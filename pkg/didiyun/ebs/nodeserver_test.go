@@ -2,6 +2,7 @@ package ebs
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,6 +13,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
@@ -22,17 +25,23 @@ func TestNodeServer(t *testing.T) {
 	driver := csicommon.NewCSIDriver(driverName, csiVersion, nodeID)
 	require.NotNil(t, driver)
 
+	mounter := &mount.FakeMounter{}
 	svr := &nodeServer{
 		nodeID:            nodeID,
 		nodeIP:            nodeIP,
 		zone:              "zone1",
-		mounter:           &mount.FakeMounter{},
+		mounter:           mounter,
+		exec:              newFakeExec(),
+		devices:           newFakeDevices(t),
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(driver),
 		ebsCli:            c.Ebs(),
 	}
 	ctx := context.Background()
 	volID, e := svr.ebsCli.Create(ctx, "", "zone1", "test-vol", "", 1000000)
 	require.NoError(t, e)
+	device, e := svr.ebsCli.Attach(ctx, volID, nodeID) // by controller
+	require.NoError(t, e)
+	plugDisk(t, svr.devices, device, virtioSerial(volID), true)
 
 	tmp, e := ioutil.TempDir("", "ebs_nodeserver_test-")
 	require.NoError(t, e)
@@ -53,11 +62,16 @@ func TestNodeServer(t *testing.T) {
 	}
 	stgReq := &csi.NodeStageVolumeRequest{
 		VolumeId:          volID,
+		PublishContext:    map[string]string{keyDeviceName: device},
 		StagingTargetPath: stagePath,
 		VolumeCapability:  volCap,
 	}
 	_, e = svr.NodeStageVolume(ctx, stgReq)
 	assert.NoError(t, e)
+	assert.Contains(t, svr.exec.(*fakeExec).commands(), "mkfs.ext4 -F -m0 "+filepath.Join(svr.devices.devDir, device), "blank devices are formatted")
+	if assert.Len(t, mounter.MountPoints, 1) {
+		assert.Equal(t, mount.MountPoint{Device: filepath.Join(svr.devices.devDir, device), Path: stagePath, Type: "ext4", Opts: []string{"defaults"}}, mounter.MountPoints[0])
+	}
 
 	pubReq := &csi.NodePublishVolumeRequest{
 		VolumeId:          volID,
@@ -67,6 +81,7 @@ func TestNodeServer(t *testing.T) {
 	}
 	_, e = svr.NodePublishVolume(ctx, pubReq)
 	assert.NoError(t, e)
+	assert.Len(t, mounter.MountPoints, 2)
 
 	unpubReq := &csi.NodeUnpublishVolumeRequest{
 		VolumeId:   volID,
@@ -81,4 +96,146 @@ func TestNodeServer(t *testing.T) {
 	}
 	_, e = svr.NodeUnstageVolume(ctx, unstgReq)
 	assert.NoError(t, e)
+	assert.Empty(t, mounter.MountPoints)
+}
+
+func TestNodeServerBlockVolume(t *testing.T) {
+	c, _ := didiyunClient.NewMock()
+	nodeID := "test-node"
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, nodeID)
+	require.NotNil(t, driver)
+
+	mounter := &mount.FakeMounter{}
+	svr := &nodeServer{
+		nodeID:            nodeID,
+		zone:              "zone1",
+		mounter:           mounter,
+		exec:              newFakeExec(),
+		devices:           newFakeDevices(t),
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(driver),
+		ebsCli:            c.Ebs(),
+	}
+	ctx := context.Background()
+	volID, e := svr.ebsCli.Create(ctx, "", "zone1", "test-vol", "", 1000000)
+	require.NoError(t, e)
+	device, e := svr.ebsCli.Attach(ctx, volID, nodeID)
+	require.NoError(t, e)
+	plugDisk(t, svr.devices, device, virtioSerial(volID), false)
+
+	tmp := t.TempDir()
+	stagePath := filepath.Join(tmp, "stage")
+	require.NoError(t, os.MkdirAll(stagePath, 0755))
+	// the parent of the target file is created by the driver
+	targetPath := filepath.Join(tmp, "publish", volID)
+
+	volCap := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	publishContext := map[string]string{keyDeviceName: device}
+	_, e = svr.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volID,
+		PublishContext:    publishContext,
+		StagingTargetPath: stagePath,
+		VolumeCapability:  volCap,
+	})
+	require.NoError(t, e)
+	assert.Empty(t, mounter.MountPoints, "block volumes are not formatted or mounted on staging")
+
+	pubReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          volID,
+		PublishContext:    publishContext,
+		StagingTargetPath: stagePath,
+		TargetPath:        targetPath,
+		VolumeCapability:  volCap,
+		Readonly:          true,
+	}
+	_, e = svr.NodePublishVolume(ctx, pubReq)
+	require.NoError(t, e)
+	info, e := os.Stat(targetPath)
+	require.NoError(t, e)
+	assert.False(t, info.IsDir(), "block volumes are published to files")
+	if assert.Len(t, mounter.MountPoints, 1) {
+		assert.Equal(t, mount.MountPoint{Device: filepath.Join(svr.devices.devDir, device), Path: targetPath, Opts: []string{"bind", "ro"}}, mounter.MountPoints[0])
+	}
+	_, e = svr.NodePublishVolume(ctx, pubReq)
+	assert.NoError(t, e, "publishing is idempotent")
+	assert.Len(t, mounter.MountPoints, 1)
+
+	unpubReq := &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: targetPath}
+	_, e = svr.NodeUnpublishVolume(ctx, unpubReq)
+	require.NoError(t, e)
+	assert.Empty(t, mounter.MountPoints)
+	_, e = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(e), "target files are removed")
+	_, e = svr.NodeUnpublishVolume(ctx, unpubReq)
+	assert.NoError(t, e, "unpublishing is idempotent")
+
+	_, e = svr.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: stagePath})
+	assert.NoError(t, e)
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	tmp := t.TempDir()
+	fsPath := filepath.Join(tmp, "fs")
+	require.NoError(t, os.MkdirAll(fsPath, 0755))
+	blockPath := filepath.Join(tmp, "block")
+	require.NoError(t, makeFile(blockPath))
+	// stands for the device
+	device := filepath.Join(tmp, "vdb")
+	require.NoError(t, makeFile(device))
+
+	exec := newFakeExec()
+	exec.reply("findmnt -J "+fsPath, fmt.Sprintf(`{"filesystems": [{"target": "%s", "source": "%s", "fstype": "ext4", "options": "rw"}]}`, fsPath, device), 0)
+	exec.reply("blockdev --getsize64 "+blockPath, "10737418240\n", 0)
+	mounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{
+		{Device: device, Path: fsPath, Type: "ext4"},
+		{Device: device, Path: blockPath, Opts: []string{"bind"}},
+	}}
+	svr := &nodeServer{mounter: mounter, exec: exec}
+	ctx := context.Background()
+
+	caps, e := svr.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, e)
+	var types []csi.NodeServiceCapability_RPC_Type
+	for _, cap := range caps.GetCapabilities() {
+		types = append(types, cap.GetRpc().GetType())
+	}
+	assert.Subset(t, types, []csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_GET_VOLUME_STATS, csi.NodeServiceCapability_RPC_VOLUME_CONDITION})
+
+	resp, e := svr.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: fsPath})
+	require.NoError(t, e)
+	assert.False(t, resp.GetVolumeCondition().GetAbnormal())
+	if assert.Len(t, resp.GetUsage(), 2) {
+		bytes, inodes := resp.GetUsage()[0], resp.GetUsage()[1]
+		assert.Equal(t, csi.VolumeUsage_BYTES, bytes.GetUnit())
+		assert.True(t, bytes.GetTotal() > 0 && bytes.GetAvailable() <= bytes.GetTotal())
+		assert.Equal(t, csi.VolumeUsage_INODES, inodes.GetUnit())
+		assert.True(t, inodes.GetTotal() > 0 && inodes.GetUsed() <= inodes.GetTotal())
+	}
+
+	resp, e = svr.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-2", VolumePath: blockPath})
+	require.NoError(t, e)
+	assert.False(t, resp.GetVolumeCondition().GetAbnormal())
+	assert.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 10 << 30}}, resp.GetUsage())
+
+	// devices disappeared
+	require.NoError(t, os.Remove(device))
+	exec.reply("blockdev --getsize64 "+blockPath, "blockdev: cannot open", 1)
+	for _, path := range []string{fsPath, blockPath} {
+		resp, e = svr.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: path})
+		require.NoError(t, e)
+		assert.True(t, resp.GetVolumeCondition().GetAbnormal(), path)
+		assert.Contains(t, resp.GetVolumeCondition().GetMessage(), "disappeared")
+		assert.Empty(t, resp.GetUsage())
+	}
+
+	// mounts missing
+	mounter.MountPoints = nil
+	resp, e = svr.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: fsPath})
+	require.NoError(t, e)
+	assert.True(t, resp.GetVolumeCondition().GetAbnormal())
+	assert.Contains(t, resp.GetVolumeCondition().GetMessage(), "not mounted")
+
+	_, e = svr.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: filepath.Join(tmp, "not-exist")})
+	assert.Equal(t, codes.NotFound, status.Code(e))
+	_, e = svr.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(e))
 }
@@ -0,0 +1,216 @@
+package ebs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"golang.org/x/time/rate"
+)
+
+// names of ebs operations, used as keys of per operation rate limits
+const (
+	opCreate = "create"
+	opGet    = "get"
+	opDelete = "delete"
+	opAttach = "attach"
+	opDetach = "detach"
+	opExpand = "expand"
+
+	opList               = "list"
+	opCreateFromSnapshot = "createFromSnapshot"
+	opCreateSnapshot     = "createSnapshot"
+	opListSnapshots      = "listSnapshots"
+	opDeleteSnapshot     = "deleteSnapshot"
+)
+
+type RateLimit struct {
+	// requests per second, no limit if not positive
+	QPS   float64 `yaml:"qps"`
+	Burst int     `yaml:"burst"`
+}
+
+type RateLimitConfig struct {
+	// limit of all ebs api calls
+	Global RateLimit `yaml:"global"`
+	// limits of each operation, keyed by create, get, delete, attach, detach, expand,
+	// list, createFromSnapshot, createSnapshot, listSnapshots and deleteSnapshot
+	Operations map[string]RateLimit `yaml:"operations"`
+}
+
+func (cfg RateLimitConfig) validate() error {
+	for op := range cfg.Operations {
+		switch op {
+		case opCreate, opGet, opDelete, opAttach, opDetach, opExpand,
+			opList, opCreateFromSnapshot, opCreateSnapshot, opListSnapshots, opDeleteSnapshot:
+		default:
+			return fmt.Errorf("unknown ebs operation %s to rate limit", op)
+		}
+	}
+	return nil
+}
+
+func newLimiter(l RateLimit) *rate.Limiter {
+	if l.QPS <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(l.QPS), burst)
+}
+
+// rateLimitedEbsClient waits for tokens from the global and the operation's limiters before calling didiyun
+type rateLimitedEbsClient struct {
+	cli didiyunClient.EbsClient
+
+	mu     sync.RWMutex
+	global *rate.Limiter
+	ops    map[string]*rate.Limiter
+}
+
+var _ didiyunClient.EbsClient = (*rateLimitedEbsClient)(nil)
+
+func newRateLimitedEbsClient(cli didiyunClient.EbsClient, cfg RateLimitConfig) (*rateLimitedEbsClient, error) {
+	t := &rateLimitedEbsClient{cli: cli}
+	if e := t.reconfigure(cfg); e != nil {
+		return nil, e
+	}
+	return t, nil
+}
+
+// reconfigure replaces all limiters, tokens already taken are not counted by the new ones
+func (t *rateLimitedEbsClient) reconfigure(cfg RateLimitConfig) error {
+	if e := cfg.validate(); e != nil {
+		return e
+	}
+	ops := make(map[string]*rate.Limiter, len(cfg.Operations))
+	for op, l := range cfg.Operations {
+		if limiter := newLimiter(l); limiter != nil {
+			ops[op] = limiter
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.global = newLimiter(cfg.Global)
+	t.ops = ops
+	return nil
+}
+
+func (t *rateLimitedEbsClient) limiters(op string) []*rate.Limiter {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return []*rate.Limiter{t.global, t.ops[op]}
+}
+
+func (t *rateLimitedEbsClient) wait(ctx context.Context, op string) error {
+	for _, limiter := range t.limiters(op) {
+		if limiter == nil {
+			continue
+		}
+		if e := limiter.Wait(ctx); e != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("wait for rate limit of %s error %w", op, ctx.Err())
+			}
+			// the wait would exceed the deadline of ctx
+			return fmt.Errorf("wait for rate limit of %s error %s: %w", op, e, context.DeadlineExceeded)
+		}
+	}
+	logger(ctx).V(5).Infof("rate limit of %s passed", op)
+	return nil
+}
+
+func (t *rateLimitedEbsClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	if e := t.wait(ctx, opCreate); e != nil {
+		return "", e
+	}
+	return t.cli.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+}
+
+func (t *rateLimitedEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	if e := t.wait(ctx, opGet); e != nil {
+		return nil, e
+	}
+	return t.cli.Get(ctx, ebsUUID)
+}
+
+func (t *rateLimitedEbsClient) Delete(ctx context.Context, ebsUUID string) error {
+	if e := t.wait(ctx, opDelete); e != nil {
+		return e
+	}
+	return t.cli.Delete(ctx, ebsUUID)
+}
+
+func (t *rateLimitedEbsClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	if e := t.wait(ctx, opAttach); e != nil {
+		return "", e
+	}
+	return t.cli.Attach(ctx, ebsUUID, dc2Name)
+}
+
+func (t *rateLimitedEbsClient) Detach(ctx context.Context, ebsUUID string) error {
+	if e := t.wait(ctx, opDetach); e != nil {
+		return e
+	}
+	return t.cli.Detach(ctx, ebsUUID)
+}
+
+func (t *rateLimitedEbsClient) Expand(ctx context.Context, ebsUUID string, sizeGB int64) error {
+	if e := t.wait(ctx, opExpand); e != nil {
+		return e
+	}
+	return t.cli.Expand(ctx, ebsUUID, sizeGB)
+}
+
+// rateLimitedCloudClient waits for tokens before calling didiyun apis not covered by didiyunClient.EbsClient,
+// which share the global limiter with the ebs client
+type rateLimitedCloudClient struct {
+	cli     cloudClient
+	limited *rateLimitedEbsClient
+}
+
+var _ cloudClient = (*rateLimitedCloudClient)(nil)
+
+// cloud returns a cloudClient limited by limiters of t, which are reconfigured together
+func (t *rateLimitedEbsClient) cloud(cli cloudClient) *rateLimitedCloudClient {
+	return &rateLimitedCloudClient{cli: cli, limited: t}
+}
+
+func (t *rateLimitedCloudClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	if e := t.limited.wait(ctx, opList); e != nil {
+		return nil, e
+	}
+	return t.cli.ListEbs(ctx, regionID, zoneID, start, limit)
+}
+
+func (t *rateLimitedCloudClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	if e := t.limited.wait(ctx, opCreateFromSnapshot); e != nil {
+		return "", e
+	}
+	return t.cli.CreateFromSnapshot(ctx, regionID, zoneID, name, typ, snapUUID, sizeGB)
+}
+
+func (t *rateLimitedCloudClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	if e := t.limited.wait(ctx, opCreateSnapshot); e != nil {
+		return "", e
+	}
+	return t.cli.CreateSnapshot(ctx, regionID, ebsUUID, name)
+}
+
+func (t *rateLimitedCloudClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	if e := t.limited.wait(ctx, opListSnapshots); e != nil {
+		return nil, e
+	}
+	return t.cli.ListSnapshots(ctx, regionID, ebsUUID, name, start, limit)
+}
+
+func (t *rateLimitedCloudClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	if e := t.limited.wait(ctx, opDeleteSnapshot); e != nil {
+		return e
+	}
+	return t.cli.DeleteSnapshot(ctx, regionID, snapUUID)
+}
@@ -0,0 +1,84 @@
+package ebs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRateLimitedEbsClient(t *testing.T) {
+	c, e := didiyunClient.NewMock()
+	require.NoError(t, e)
+	ctx := context.Background()
+
+	_, e = newRateLimitedEbsClient(c.Ebs(), RateLimitConfig{Operations: map[string]RateLimit{"resize": {QPS: 1}}})
+	assert.Error(t, e, "unknown operation")
+
+	cli, e := newRateLimitedEbsClient(c.Ebs(), RateLimitConfig{
+		Global:     RateLimit{QPS: 100, Burst: 10},
+		Operations: map[string]RateLimit{opAttach: {QPS: 10, Burst: 1}},
+	})
+	require.NoError(t, e)
+
+	id, e := cli.Create(ctx, "gz", "gz01", "pvc-1", "SSD", 20)
+	require.NoError(t, e)
+	for i := 0; i < 5; i++ {
+		_, e := cli.Get(ctx, id)
+		assert.NoError(t, e, "gets are only limited by the global limiter")
+	}
+
+	start := time.Now()
+	_, e = cli.Attach(ctx, id, "node-1")
+	require.NoError(t, e)
+	require.NoError(t, cli.Detach(ctx, id))
+	_, e = cli.Attach(ctx, id, "node-1")
+	require.NoError(t, e)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "the second attach waits for a token")
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.NoError(t, cli.Detach(ctx, id))
+	_, e = cli.Attach(ctx, id, "node-1")
+	assert.Equal(t, codes.DeadlineExceeded, errorCode(e), "no token before the deadline")
+}
+
+func TestRateLimitedCloudClient(t *testing.T) {
+	c, e := didiyunClient.NewMock()
+	require.NoError(t, e)
+	ctx := context.Background()
+	mock := newMockCloudClient()
+	mock.addEbs("vol-1", "gz", "gz01", "pvc-1", "SSD", 20)
+
+	limited, e := newRateLimitedEbsClient(c.Ebs(), RateLimitConfig{
+		Global:     RateLimit{QPS: 100, Burst: 10},
+		Operations: map[string]RateLimit{opList: {QPS: 10, Burst: 1}},
+	})
+	require.NoError(t, e)
+	cli := limited.cloud(mock)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		infos, e := cli.ListEbs(ctx, "gz", "", 0, 10)
+		require.NoError(t, e)
+		assert.Len(t, infos, 1)
+	}
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "the second list waits for a token")
+	for i := 0; i < 5; i++ {
+		_, e := cli.ListSnapshots(ctx, "gz", "vol-1", "", 0, 10)
+		assert.NoError(t, e, "listing snapshots is only limited by the global limiter")
+	}
+
+	// the global limiter is shared with ebs calls
+	require.NoError(t, limited.reconfigure(RateLimitConfig{Global: RateLimit{QPS: 1, Burst: 1}}))
+	_, e = limited.Get(ctx, "not-found")
+	assert.Error(t, e)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, e = cli.CreateSnapshot(ctx, "gz", "vol-1", "snap-1")
+	assert.Equal(t, codes.DeadlineExceeded, errorCode(e), "no token before the deadline")
+}
@@ -0,0 +1,226 @@
+package ebs
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+)
+
+type RetryConfig struct {
+	// retries after the first attempt, 0 for the default, or negative to disable retrying
+	MaxRetries     int           `yaml:"maxRetries"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	// backoff is multiplied by the factor after each retry
+	Factor float64 `yaml:"factor"`
+	// backoff is randomly increased by at most jitter of itself
+	Jitter float64 `yaml:"jitter"`
+}
+
+var defaultRetryConfig = RetryConfig{
+	MaxRetries:     5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Factor:         2,
+	Jitter:         0.2,
+}
+
+// withDefaults fills zero fields by default values
+func (cfg RetryConfig) withDefaults() RetryConfig {
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultRetryConfig.MaxRetries
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultRetryConfig.InitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultRetryConfig.MaxBackoff
+	}
+	if cfg.Factor < 1 {
+		cfg.Factor = defaultRetryConfig.Factor
+	}
+	if cfg.Jitter < 0 {
+		cfg.Jitter = 0
+	}
+	return cfg
+}
+
+// backoff returns the duration to wait before the nth retry, starts from 0
+func (cfg RetryConfig) backoff(n int) time.Duration {
+	d := float64(cfg.InitialBackoff)
+	for i := 0; i < n && d < float64(cfg.MaxBackoff); i++ {
+		d *= cfg.Factor
+	}
+	if d > float64(cfg.MaxBackoff) {
+		d = float64(cfg.MaxBackoff)
+	}
+	d += d * cfg.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// retryingEbsClient retries failed calls to didiyun with exponential backoff, if the errors are retryable
+type retryingEbsClient struct {
+	cli didiyunClient.EbsClient
+
+	mu  sync.RWMutex
+	cfg RetryConfig
+}
+
+var _ didiyunClient.EbsClient = (*retryingEbsClient)(nil)
+
+func newRetryingEbsClient(cli didiyunClient.EbsClient, cfg RetryConfig) *retryingEbsClient {
+	return &retryingEbsClient{cli: cli, cfg: cfg.withDefaults()}
+}
+
+// reconfigure applies to calls started afterwards
+func (t *retryingEbsClient) reconfigure(cfg RetryConfig) {
+	t.mu.Lock()
+	t.cfg = cfg.withDefaults()
+	t.mu.Unlock()
+}
+
+func (t *retryingEbsClient) config() RetryConfig {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cfg
+}
+
+// retryable tells if a failed call could be tried again.
+// calls not idempotent are retried only if the request is not likely to be accepted by didiyun.
+func retryable(e error, idempotent bool) bool {
+	switch errorCode(e) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded, codes.Aborted:
+		return idempotent
+	}
+	return false
+}
+
+func (t *retryingEbsClient) do(ctx context.Context, op string, idempotent bool, fn func() error) error {
+	cfg := t.config()
+	for n := 0; ; n++ {
+		e := fn()
+		if e == nil || n >= cfg.MaxRetries || !retryable(e, idempotent) || ctx.Err() != nil {
+			return e
+		}
+
+		backoff := cfg.backoff(n)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			logger(ctx).V(4).Infof("%s failed: %s, no time left to retry", op, e)
+			return e
+		}
+		logger(ctx).V(4).Infof("%s failed: %s, retry in %s", op, e, backoff)
+		select {
+		case <-ctx.Done():
+			return e
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (t *retryingEbsClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	var id string
+	e := t.do(ctx, "create ebs "+name, false, func() (e error) {
+		id, e = t.cli.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+		return e
+	})
+	return id, e
+}
+
+func (t *retryingEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	var info *compute.EbsInfo
+	e := t.do(ctx, "get ebs "+ebsUUID, true, func() (e error) {
+		info, e = t.cli.Get(ctx, ebsUUID)
+		return e
+	})
+	return info, e
+}
+
+func (t *retryingEbsClient) Delete(ctx context.Context, ebsUUID string) error {
+	return t.do(ctx, "delete ebs "+ebsUUID, true, func() error {
+		return t.cli.Delete(ctx, ebsUUID)
+	})
+}
+
+func (t *retryingEbsClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	var device string
+	e := t.do(ctx, "attach ebs "+ebsUUID, true, func() (e error) {
+		device, e = t.cli.Attach(ctx, ebsUUID, dc2Name)
+		return e
+	})
+	return device, e
+}
+
+func (t *retryingEbsClient) Detach(ctx context.Context, ebsUUID string) error {
+	return t.do(ctx, "detach ebs "+ebsUUID, true, func() error {
+		return t.cli.Detach(ctx, ebsUUID)
+	})
+}
+
+func (t *retryingEbsClient) Expand(ctx context.Context, ebsUUID string, sizeGB int64) error {
+	return t.do(ctx, "expand ebs "+ebsUUID, true, func() error {
+		return t.cli.Expand(ctx, ebsUUID, sizeGB)
+	})
+}
+
+// retryingCloudClient retries failed calls of didiyun apis not covered by didiyunClient.EbsClient,
+// by the same config of the ebs client
+type retryingCloudClient struct {
+	cli      cloudClient
+	retrying *retryingEbsClient
+}
+
+var _ cloudClient = (*retryingCloudClient)(nil)
+
+// cloud returns a cloudClient retrying by the config of t, which is reconfigured together
+func (t *retryingEbsClient) cloud(cli cloudClient) *retryingCloudClient {
+	return &retryingCloudClient{cli: cli, retrying: t}
+}
+
+func (t *retryingCloudClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	var infos []*compute.EbsInfo
+	e := t.retrying.do(ctx, "list ebs in "+regionID+"/"+zoneID, true, func() (e error) {
+		infos, e = t.cli.ListEbs(ctx, regionID, zoneID, start, limit)
+		return e
+	})
+	return infos, e
+}
+
+func (t *retryingCloudClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	var id string
+	e := t.retrying.do(ctx, "create ebs "+name+" from snapshot "+snapUUID, false, func() (e error) {
+		id, e = t.cli.CreateFromSnapshot(ctx, regionID, zoneID, name, typ, snapUUID, sizeGB)
+		return e
+	})
+	return id, e
+}
+
+func (t *retryingCloudClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	var id string
+	e := t.retrying.do(ctx, "create snapshot "+name, false, func() (e error) {
+		id, e = t.cli.CreateSnapshot(ctx, regionID, ebsUUID, name)
+		return e
+	})
+	return id, e
+}
+
+func (t *retryingCloudClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	var snaps []*compute.SnapInfo
+	e := t.retrying.do(ctx, "list snapshots in "+regionID, true, func() (e error) {
+		snaps, e = t.cli.ListSnapshots(ctx, regionID, ebsUUID, name, start, limit)
+		return e
+	})
+	return snaps, e
+}
+
+func (t *retryingCloudClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	return t.retrying.do(ctx, "delete snapshot "+snapUUID, true, func() error {
+		return t.cli.DeleteSnapshot(ctx, regionID, snapUUID)
+	})
+}
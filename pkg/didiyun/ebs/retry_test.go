@@ -0,0 +1,163 @@
+package ebs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+)
+
+// flakyEbsClient fails the first calls with errs, one by one
+type flakyEbsClient struct {
+	didiyunClient.EbsClient
+	errs  []error
+	calls int
+}
+
+func (t *flakyEbsClient) fail() error {
+	t.calls++
+	if len(t.errs) == 0 {
+		return nil
+	}
+	e := t.errs[0]
+	t.errs = t.errs[1:]
+	return e
+}
+
+func (t *flakyEbsClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	if e := t.fail(); e != nil {
+		return "", e
+	}
+	return t.EbsClient.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+}
+
+func (t *flakyEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	if e := t.fail(); e != nil {
+		return nil, e
+	}
+	return t.EbsClient.Get(ctx, ebsUUID)
+}
+
+func TestRetryingEbsClient(t *testing.T) {
+	c, e := didiyunClient.NewMock()
+	require.NoError(t, e)
+	ctx := context.Background()
+	cfg := RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, Jitter: 0.5}
+
+	throttled := errors.New("attach ebs error 请求过于频繁 (42900)")
+	timeout := errors.New("failed to create ebs: request timeout")
+	invalid := errors.New("create ebs error invalid disk type (40001)")
+
+	flaky := &flakyEbsClient{EbsClient: c.Ebs(), errs: []error{throttled, throttled}}
+	cli := newRetryingEbsClient(flaky, cfg)
+	id, e := cli.Create(ctx, "gz", "gz01", "pvc-1", "SSD", 20)
+	if assert.NoError(t, e, "retry throttled calls") {
+		assert.NotEmpty(t, id)
+		assert.Equal(t, 3, flaky.calls)
+	}
+
+	flaky.calls, flaky.errs = 0, []error{timeout}
+	_, e = cli.Create(ctx, "gz", "gz01", "pvc-2", "SSD", 20)
+	assert.Equal(t, timeout, e, "creating is not idempotent")
+	assert.Equal(t, 1, flaky.calls)
+
+	flaky.calls, flaky.errs = 0, []error{timeout, timeout}
+	_, e = cli.Get(ctx, id)
+	assert.NoError(t, e, "getting is idempotent")
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky.calls, flaky.errs = 0, []error{invalid}
+	_, e = cli.Create(ctx, "gz", "gz01", "pvc-3", "XX", 20)
+	assert.Equal(t, invalid, e, "invalid arguments are not retryable")
+	assert.Equal(t, 1, flaky.calls)
+
+	flaky.calls, flaky.errs = 0, []error{throttled, throttled, throttled, throttled, throttled}
+	_, e = cli.Get(ctx, id)
+	assert.Equal(t, throttled, e, "max retries exceeded")
+	assert.Equal(t, 4, flaky.calls)
+
+	cli = newRetryingEbsClient(flaky, RetryConfig{MaxRetries: 3, InitialBackoff: time.Hour})
+	flaky.calls, flaky.errs = 0, []error{throttled, throttled}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, e = cli.Get(ctx, id)
+	assert.Equal(t, throttled, e, "backoff exceeds the deadline")
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := RetryConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Factor: 2}.withDefaults()
+	cfg.Jitter = 0
+	assert.Equal(t, time.Second, cfg.backoff(0))
+	assert.Equal(t, 4*time.Second, cfg.backoff(2))
+	assert.Equal(t, 10*time.Second, cfg.backoff(10))
+
+	cfg.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := cfg.backoff(1)
+		assert.True(t, d >= 2*time.Second && d <= 3*time.Second, "%s", d)
+	}
+}
+
+type flakyCloudClient struct {
+	*mockCloudClient
+	errs  []error
+	calls int
+}
+
+func (t *flakyCloudClient) fail() error {
+	t.calls++
+	if len(t.errs) == 0 {
+		return nil
+	}
+	e := t.errs[0]
+	t.errs = t.errs[1:]
+	return e
+}
+
+func (t *flakyCloudClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	if e := t.fail(); e != nil {
+		return nil, e
+	}
+	return t.mockCloudClient.ListEbs(ctx, regionID, zoneID, start, limit)
+}
+
+func (t *flakyCloudClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	if e := t.fail(); e != nil {
+		return "", e
+	}
+	return t.mockCloudClient.CreateSnapshot(ctx, regionID, ebsUUID, name)
+}
+
+func TestRetryingCloudClient(t *testing.T) {
+	ctx := context.Background()
+	throttled := errors.New("list ebs error rate limit exceeded (42900)")
+	timeout := errors.New("failed to create snapshot: request timeout")
+
+	flaky := &flakyCloudClient{mockCloudClient: newMockCloudClient(), errs: []error{throttled, throttled}}
+	flaky.addEbs("vol-1", "gz", "gz01", "pvc-1", "SSD", 20)
+	retrying := newRetryingEbsClient(nil, RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	cli := retrying.cloud(flaky)
+
+	infos, e := cli.ListEbs(ctx, "gz", "", 0, 10)
+	if assert.NoError(t, e, "retry throttled calls") {
+		assert.Len(t, infos, 1)
+		assert.Equal(t, 3, flaky.calls)
+	}
+
+	flaky.calls, flaky.errs = 0, []error{timeout}
+	_, e = cli.CreateSnapshot(ctx, "gz", "vol-1", "snap-1")
+	assert.Equal(t, timeout, e, "creating is not idempotent")
+	assert.Equal(t, 1, flaky.calls)
+
+	retrying.reconfigure(RetryConfig{MaxRetries: -1})
+	flaky.calls, flaky.errs = 0, []error{throttled}
+	_, e = cli.ListEbs(ctx, "gz", "", 0, 10)
+	assert.Equal(t, throttled, e, "reconfigured together with the ebs client")
+	assert.Equal(t, 1, flaky.calls)
+}
@@ -0,0 +1,152 @@
+package ebs
+
+import (
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+const defaultShutdownGracePeriod = 25 * time.Second
+
+// nonBlockingGRPCServer works like the one of csicommon, but with interceptors,
+// and keeps track of in-flight requests to drain them on shutdown
+type nonBlockingGRPCServer struct {
+	wg     sync.WaitGroup
+	server *grpc.Server
+
+	mu       sync.Mutex
+	inflight map[*inflightRequest]struct{}
+}
+
+type inflightRequest struct {
+	id     string
+	method string
+	volume string
+	start  time.Time
+}
+
+var _ csicommon.NonBlockingGRPCServer = (*nonBlockingGRPCServer)(nil)
+
+func newNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) *nonBlockingGRPCServer {
+	s := &nonBlockingGRPCServer{inflight: make(map[*inflightRequest]struct{})}
+	// track requests innermost, after request ids are assigned
+	interceptors = append(interceptors, s.track)
+	s.server = grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+	return s
+}
+
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	if ids != nil {
+		csi.RegisterIdentityServer(s.server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(s.server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.server, ns)
+	}
+
+	s.wg.Add(1)
+	go s.serve(endpoint)
+}
+
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *nonBlockingGRPCServer) Stop() {
+	s.server.GracefulStop()
+}
+
+func (s *nonBlockingGRPCServer) ForceStop() {
+	s.server.Stop()
+}
+
+// drain stops accepting new requests, and waits for in-flight ones to finish in the grace period.
+// requests not finished in time are logged and returned, then the server is stopped forcibly.
+func (s *nonBlockingGRPCServer) drain(grace time.Duration) []inflightRequest {
+	if grace <= 0 {
+		grace = defaultShutdownGracePeriod
+	}
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		klog.Info("All in-flight requests are drained")
+		return nil
+	case <-time.After(grace):
+	}
+
+	unfinished := s.requests()
+	for _, r := range unfinished {
+		klog.Warningf("[%s] %s of volume %q not finished in grace period %s, started %s ago, it should be reconciled later",
+			r.id, r.method, r.volume, grace, time.Since(r.start).Round(time.Millisecond))
+	}
+	s.server.Stop()
+	return unfinished
+}
+
+func (s *nonBlockingGRPCServer) track(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r := &inflightRequest{
+		id:     requestID(ctx),
+		method: path.Base(info.FullMethod),
+		volume: requestVolume(req),
+		start:  time.Now(),
+	}
+	s.mu.Lock()
+	s.inflight[r] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.inflight, r)
+		s.mu.Unlock()
+	}()
+	return handler(ctx, req)
+}
+
+func (s *nonBlockingGRPCServer) requests() []inflightRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]inflightRequest, 0, len(s.inflight))
+	for r := range s.inflight {
+		requests = append(requests, *r)
+	}
+	return requests
+}
+
+func (s *nonBlockingGRPCServer) serve(endpoint string) {
+	defer s.wg.Done()
+
+	proto, addr, e := csicommon.ParseEndpoint(endpoint)
+	if e != nil {
+		klog.Fatal(e.Error())
+	}
+	if proto == "unix" {
+		addr = "/" + addr
+		if e := os.Remove(addr); e != nil && !os.IsNotExist(e) {
+			klog.Fatalf("Failed to remove %s, error: %s", addr, e)
+		}
+	}
+
+	listener, e := net.Listen(proto, addr)
+	if e != nil {
+		klog.Fatalf("Failed to listen: %v", e)
+	}
+
+	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+	if e := s.server.Serve(listener); e != nil {
+		klog.Errorf("grpc server stopped: %s", e)
+	}
+}
@@ -0,0 +1,80 @@
+package ebs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type blockingIdentityServer struct {
+	csi.UnimplementedIdentityServer
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	s.entered <- struct{}{}
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+	}
+	return &csi.ProbeResponse{}, nil
+}
+
+func startBlockingServer(t *testing.T) (*nonBlockingGRPCServer, *blockingIdentityServer, csi.IdentityClient) {
+	ids := &blockingIdentityServer{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	sock := filepath.Join(t.TempDir(), "csi.sock")
+	s := newNonBlockingGRPCServer(loggingInterceptor)
+	s.Start("unix://"+sock, ids, nil, nil)
+
+	conn, e := grpc.Dial("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, e)
+	t.Cleanup(func() { conn.Close() })
+	return s, ids, csi.NewIdentityClient(conn)
+}
+
+func TestDrainFinished(t *testing.T) {
+	s, ids, client := startBlockingServer(t)
+
+	probed := make(chan error, 1)
+	go func() {
+		_, e := client.Probe(context.Background(), &csi.ProbeRequest{})
+		probed <- e
+	}()
+	<-ids.entered
+	require.Len(t, s.requests(), 1)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(ids.release)
+	}()
+	assert.Empty(t, s.drain(10*time.Second), "in-flight requests are drained")
+	assert.NoError(t, <-probed)
+	s.Wait()
+}
+
+func TestDrainTimeout(t *testing.T) {
+	s, ids, client := startBlockingServer(t)
+
+	probed := make(chan error, 1)
+	go func() {
+		_, e := client.Probe(context.Background(), &csi.ProbeRequest{})
+		probed <- e
+	}()
+	<-ids.entered
+
+	unfinished := s.drain(50 * time.Millisecond)
+	if assert.Len(t, unfinished, 1) {
+		assert.Equal(t, "Probe", unfinished[0].method)
+		assert.NotEmpty(t, unfinished[0].id)
+	}
+	assert.Error(t, <-probed, "requests are aborted after the grace period")
+	s.Wait()
+}
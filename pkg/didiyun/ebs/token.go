@@ -0,0 +1,361 @@
+package ebs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// clients of didiyun authorized by the same token
+type clients struct {
+	ebs   didiyunClient.EbsClient
+	cloud cloudClient
+	// closers of connections
+	closers []io.Closer
+
+	// calls in flight
+	wg sync.WaitGroup
+}
+
+func (c *clients) closeAfterCalls() {
+	c.wg.Wait()
+	c.close()
+}
+
+func (c *clients) close() {
+	for _, closer := range c.closers {
+		if e := closer.Close(); e != nil {
+			klog.Errorf("close didiyun client error: %s", e)
+		}
+	}
+}
+
+// newClientsFunc creates clients authorized by the token
+type newClientsFunc func(token string) (*clients, error)
+
+func dialClients(timeout time.Duration) newClientsFunc {
+	return func(token string) (*clients, error) {
+		cli, e := didiyunClient.New(&didiyunClient.Config{Token: token, Timeout: timeout})
+		if e != nil {
+			return nil, e
+		}
+		cloudCli, e := newCloudClient(token)
+		if e != nil {
+			if closer, ok := cli.(io.Closer); ok {
+				closer.Close()
+			}
+			return nil, e
+		}
+		c := &clients{ebs: cli.Ebs(), cloud: cloudCli, closers: []io.Closer{cloudCli}}
+		if closer, ok := cli.(io.Closer); ok {
+			c.closers = append(c.closers, closer)
+		}
+		return c, nil
+	}
+}
+
+// readTokenFile returns the token in the file, surrounding spaces are trimmed
+func readTokenFile(path string) (string, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return "", fmt.Errorf("read token file error %w", e)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("token file is empty")
+	}
+	return token, nil
+}
+
+// secrets of storage classes carry tokens of didiyun accounts by this key
+const (
+	secretTokenKey = "token"
+	// clients of accounts least recently used are closed if there are more
+	maxAccounts = 32
+)
+
+type tokenKey struct{}
+
+// withToken returns ctx in which didiyun is called by the account of token, or the default one if empty
+func withToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+func tokenOf(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// withSecrets returns ctx in which didiyun is called by the account of the token in csi secrets,
+// the default account is used if there are no secrets
+func withSecrets(ctx context.Context, secrets map[string]string) (context.Context, error) {
+	if len(secrets) == 0 {
+		return ctx, nil
+	}
+	token := strings.TrimSpace(secrets[secretTokenKey])
+	if token == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is missing in secrets", secretTokenKey)
+	}
+	return withToken(ctx, token), nil
+}
+
+type account struct {
+	clients *clients
+	used    time.Time
+}
+
+// rotatingClient calls didiyun by clients of the token in ctx, or of the latest default token.
+// on rotating, calls in flight keep using the previous clients, which are closed after the calls finish.
+type rotatingClient struct {
+	mu         sync.RWMutex
+	newClients newClientsFunc
+	token      string
+	current    *clients
+
+	// clients of tokens from secrets, created on demand
+	accountsMu sync.Mutex
+	accounts   map[string]*account
+}
+
+var (
+	_ didiyunClient.EbsClient = (*rotatingClient)(nil)
+	_ cloudClient             = (*rotatingClient)(nil)
+)
+
+func newRotatingClient(token string, newClients newClientsFunc) (*rotatingClient, error) {
+	c, e := newClients(token)
+	if e != nil {
+		return nil, e
+	}
+	return &rotatingClient{newClients: newClients, token: token, current: c, accounts: make(map[string]*account)}, nil
+}
+
+func (t *rotatingClient) dialer() newClientsFunc {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.newClients
+}
+
+// rotate swaps clients by the token
+func (t *rotatingClient) rotate(token string) error {
+	c, e := t.dialer()(token)
+	if e != nil {
+		return e
+	}
+	t.mu.Lock()
+	prev := t.current
+	t.current = c
+	t.token = token
+	t.mu.Unlock()
+
+	go prev.closeAfterCalls()
+	return nil
+}
+
+// redial swaps clients of the default token by newClients, like with another timeout,
+// clients of accounts by secrets are closed, and created again by newClients on demand
+func (t *rotatingClient) redial(newClients newClientsFunc) error {
+	t.mu.RLock()
+	token := t.token
+	t.mu.RUnlock()
+	c, e := newClients(token)
+	if e != nil {
+		return e
+	}
+	t.mu.Lock()
+	prev := t.current
+	t.current = c
+	t.newClients = newClients
+	t.mu.Unlock()
+	go prev.closeAfterCalls()
+
+	t.accountsMu.Lock()
+	defer t.accountsMu.Unlock()
+	for token, a := range t.accounts {
+		delete(t.accounts, token)
+		go a.clients.closeAfterCalls()
+	}
+	return nil
+}
+
+// watchTokenFile rotates clients when the token file changes, until ctx is done
+func (t *rotatingClient) watchTokenFile(ctx context.Context, path string) error {
+	return watchFile(ctx, path, func([]byte) {
+		token, e := readTokenFile(path)
+		if e == nil {
+			e = t.rotate(token)
+		}
+		if e != nil {
+			klog.Errorf("rotate token by file %s error, keep the token in effect: %s", path, e)
+			return
+		}
+		klog.Infof("token rotated by file %s", path)
+	})
+}
+
+// acquire returns clients of the token in ctx, or the current default clients, which must be released after the call
+func (t *rotatingClient) acquire(ctx context.Context) (*clients, error) {
+	if token := tokenOf(ctx); token != "" {
+		return t.acquireAccount(token)
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.current.wg.Add(1)
+	return t.current, nil
+}
+
+func (t *rotatingClient) acquireAccount(token string) (*clients, error) {
+	t.accountsMu.Lock()
+	defer t.accountsMu.Unlock()
+
+	a, ok := t.accounts[token]
+	if !ok {
+		c, e := t.dialer()(token)
+		if e != nil {
+			return nil, status.Errorf(codes.Unavailable, "create didiyun client by secrets error %s", e)
+		}
+		if len(t.accounts) >= maxAccounts {
+			t.evictAccount()
+		}
+		a = &account{clients: c}
+		t.accounts[token] = a
+		klog.V(2).Infof("created didiyun client of account %s by secrets", maskToken(token))
+	}
+	a.used = time.Now()
+	a.clients.wg.Add(1)
+	return a.clients, nil
+}
+
+// evictAccount closes clients of the account least recently used
+func (t *rotatingClient) evictAccount() {
+	var oldest string
+	for token, a := range t.accounts {
+		if oldest == "" || a.used.Before(t.accounts[oldest].used) {
+			oldest = token
+		}
+	}
+	a := t.accounts[oldest]
+	delete(t.accounts, oldest)
+	go a.clients.closeAfterCalls()
+}
+
+// maskToken keeps only the last 4 characters of token to tell accounts in logs
+func maskToken(token string) string {
+	if len(token) <= 4 {
+		return "****"
+	}
+	return "****" + token[len(token)-4:]
+}
+
+func (t *rotatingClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return "", e
+	}
+	defer c.wg.Done()
+	return c.ebs.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+}
+
+func (t *rotatingClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return nil, e
+	}
+	defer c.wg.Done()
+	return c.ebs.Get(ctx, ebsUUID)
+}
+
+func (t *rotatingClient) Delete(ctx context.Context, ebsUUID string) error {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return e
+	}
+	defer c.wg.Done()
+	return c.ebs.Delete(ctx, ebsUUID)
+}
+
+func (t *rotatingClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return "", e
+	}
+	defer c.wg.Done()
+	return c.ebs.Attach(ctx, ebsUUID, dc2Name)
+}
+
+func (t *rotatingClient) Detach(ctx context.Context, ebsUUID string) error {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return e
+	}
+	defer c.wg.Done()
+	return c.ebs.Detach(ctx, ebsUUID)
+}
+
+func (t *rotatingClient) Expand(ctx context.Context, ebsUUID string, sizeGB int64) error {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return e
+	}
+	defer c.wg.Done()
+	return c.ebs.Expand(ctx, ebsUUID, sizeGB)
+}
+
+func (t *rotatingClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return nil, e
+	}
+	defer c.wg.Done()
+	return c.cloud.ListEbs(ctx, regionID, zoneID, start, limit)
+}
+
+func (t *rotatingClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return "", e
+	}
+	defer c.wg.Done()
+	return c.cloud.CreateFromSnapshot(ctx, regionID, zoneID, name, typ, snapUUID, sizeGB)
+}
+
+func (t *rotatingClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return "", e
+	}
+	defer c.wg.Done()
+	return c.cloud.CreateSnapshot(ctx, regionID, ebsUUID, name)
+}
+
+func (t *rotatingClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return nil, e
+	}
+	defer c.wg.Done()
+	return c.cloud.ListSnapshots(ctx, regionID, ebsUUID, name, start, limit)
+}
+
+func (t *rotatingClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	c, e := t.acquire(ctx)
+	if e != nil {
+		return e
+	}
+	defer c.wg.Done()
+	return c.cloud.DeleteSnapshot(ctx, regionID, snapUUID)
+}
@@ -0,0 +1,210 @@
+package ebs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type closeRecorder struct {
+	mu        sync.Mutex
+	closed    map[string]bool
+	blockings map[string]*blockingEbsClient
+}
+
+func (r *closeRecorder) blocking(token string) *blockingEbsClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.blockings[token]
+}
+
+func (r *closeRecorder) isClosed(token string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed[token]
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func TestRotatingClient(t *testing.T) {
+	recorder := &closeRecorder{closed: make(map[string]bool), blockings: make(map[string]*blockingEbsClient)}
+	newClients := func(token string) (*clients, error) {
+		c, e := didiyunClient.NewMock()
+		if e != nil {
+			return nil, e
+		}
+		blocking := newBlockingEbsClient(c.Ebs())
+		recorder.mu.Lock()
+		recorder.blockings[token] = blocking
+		recorder.mu.Unlock()
+		return &clients{
+			ebs:   blocking,
+			cloud: newMockCloudClient(),
+			closers: []io.Closer{closerFunc(func() error {
+				recorder.mu.Lock()
+				recorder.closed[token] = true
+				recorder.mu.Unlock()
+				return nil
+			})},
+		}, nil
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("token-1\n"), 0600))
+	token, e := readTokenFile(path)
+	require.NoError(t, e)
+	assert.Equal(t, "token-1", token)
+
+	cli, e := newRotatingClient(token, newClients)
+	require.NoError(t, e)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, cli.watchTokenFile(ctx, path))
+
+	// an attachment in flight by the first token
+	attached := make(chan error, 1)
+	go func() {
+		_, e := cli.Attach(context.Background(), "vol-1", "node-1")
+		attached <- e
+	}()
+	<-recorder.blocking("token-1").entered
+
+	require.NoError(t, os.WriteFile(path, []byte("token-2\n"), 0600))
+	assert.Eventually(t, func() bool {
+		c, e := cli.acquire(context.Background())
+		require.NoError(t, e)
+		defer c.wg.Done()
+		return c.ebs == didiyunClient.EbsClient(recorder.blocking("token-2"))
+	}, 5*time.Second, 10*time.Millisecond, "token is rotated")
+
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, recorder.isClosed("token-1"), "clients are not closed while calls are in flight")
+	close(recorder.blocking("token-1").release)
+	<-attached
+	assert.Eventually(t, func() bool {
+		return recorder.isClosed("token-1")
+	}, 5*time.Second, 10*time.Millisecond, "previous clients are closed after calls finish")
+	assert.False(t, recorder.isClosed("token-2"))
+}
+
+func TestAccountsBySecrets(t *testing.T) {
+	var created []string
+	accounts := make(map[string]didiyunClient.EbsClient)
+	cli, e := newRotatingClient("default", func(token string) (*clients, error) {
+		c, e := didiyunClient.NewMock()
+		if e != nil {
+			return nil, e
+		}
+		created = append(created, token)
+		accounts[token] = c.Ebs()
+		return &clients{ebs: accounts[token], cloud: newMockCloudClient()}, nil
+	})
+	require.NoError(t, e)
+
+	driver := csicommon.NewCSIDriver(driverName, csiVersion, "test-node")
+	require.NotNil(t, driver)
+	svr := NewControllerServer(driver, &DriverConfig{}, cli, cli)
+	ctx := context.Background()
+	volID, e := accounts["default"].Create(ctx, "", "zone1", "vol-default", "", 10)
+	require.NoError(t, e)
+
+	secrets := map[string]string{secretTokenKey: "account-1"}
+	resp, e := svr.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}},
+		Parameters:         map[string]string{keyRegion: "gz", keyZone: "gz01"},
+		Secrets:            secrets,
+	})
+	require.NoError(t, e)
+	_, e = accounts["account-1"].Get(ctx, resp.GetVolume().GetVolumeId())
+	assert.NoError(t, e, "volume is created in the account of secrets")
+
+	_, e = svr.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      resp.GetVolume().GetVolumeId(),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 << 30},
+		Secrets:       secrets,
+	})
+	assert.NoError(t, e)
+	_, e = svr.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	assert.NoError(t, e, "default account is used without secrets")
+	assert.Equal(t, []string{"default", "account-1"}, created, "clients of accounts are cached")
+
+	_, e = svr.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID, Secrets: map[string]string{"key": "value"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(e))
+}
+
+func TestEvictAccounts(t *testing.T) {
+	recorder := &closeRecorder{closed: make(map[string]bool)}
+	cli, e := newRotatingClient("default", func(token string) (*clients, error) {
+		return &clients{closers: []io.Closer{closerFunc(func() error {
+			recorder.mu.Lock()
+			recorder.closed[token] = true
+			recorder.mu.Unlock()
+			return nil
+		})}}, nil
+	})
+	require.NoError(t, e)
+
+	for i := 0; i <= maxAccounts; i++ {
+		c, e := cli.acquire(withToken(context.Background(), fmt.Sprintf("account-%d", i)))
+		require.NoError(t, e)
+		c.wg.Done()
+	}
+	assert.Len(t, cli.accounts, maxAccounts)
+	assert.Eventually(t, func() bool {
+		return recorder.isClosed("account-0")
+	}, 5*time.Second, 10*time.Millisecond, "least recently used account is closed")
+	assert.False(t, recorder.isClosed("default"))
+}
+
+func TestRedial(t *testing.T) {
+	recorder := &closeRecorder{closed: make(map[string]bool)}
+	dial := func(generation string) newClientsFunc {
+		return func(token string) (*clients, error) {
+			return &clients{closers: []io.Closer{closerFunc(func() error {
+				recorder.mu.Lock()
+				recorder.closed[generation+"/"+token] = true
+				recorder.mu.Unlock()
+				return nil
+			})}}, nil
+		}
+	}
+	cli, e := newRotatingClient("default", dial("first"))
+	require.NoError(t, e)
+	require.NoError(t, cli.rotate("rotated"))
+	c, e := cli.acquire(withToken(context.Background(), "account"))
+	require.NoError(t, e)
+	c.wg.Done()
+
+	require.NoError(t, cli.redial(dial("second")))
+	assert.Eventually(t, func() bool {
+		return recorder.isClosed("first/rotated") && recorder.isClosed("first/account")
+	}, 5*time.Second, 10*time.Millisecond, "clients dialed before are closed")
+	assert.Empty(t, cli.accounts)
+
+	c, e = cli.acquire(withToken(context.Background(), "account"))
+	require.NoError(t, e)
+	c.wg.Done()
+	require.NoError(t, cli.redial(dial("third")))
+	assert.Eventually(t, func() bool {
+		return recorder.isClosed("second/rotated") && recorder.isClosed("second/account")
+	}, 5*time.Second, 10*time.Millisecond, "clients are dialed again with the rotated token")
+}
@@ -0,0 +1,175 @@
+package ebs
+
+import (
+	"os/exec"
+
+	"github.com/didiyun/didiyun-go-sdk/compute/v1"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "github.com/supremind/csi-didiyun-ebs/pkg/didiyun/ebs"
+
+// setupTracing exports spans to the otlp grpc endpoint, spans are dropped before it is called
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, e := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if e != nil {
+		return nil, e
+	}
+	res, e := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(driverName),
+		semconv.ServiceVersion(csiVersion),
+	))
+	if e != nil {
+		return nil, e
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error if any, and ends the span
+func endSpan(span trace.Span, e error) {
+	if e != nil {
+		span.RecordError(e)
+		span.SetStatus(codes.Error, e.Error())
+	}
+	span.End()
+}
+
+// tracingInterceptor starts a span for each csi rpc
+func tracingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startSpan(ctx, info.FullMethod,
+		semconv.RPCSystemGRPC,
+		attribute.String("csi.volume", requestVolume(req)),
+	)
+	resp, e := handler(ctx, req)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(status.Code(e))))
+	endSpan(span, e)
+	return resp, e
+}
+
+// runCommand runs the command in a span
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	_, span := startSpan(ctx, "exec "+name, attribute.StringSlice("exec.args", args))
+	out, e := exec.Command(name, args...).CombinedOutput()
+	endSpan(span, e)
+	return out, e
+}
+
+// tracingEbsClient starts a span for each ebs api call
+type tracingEbsClient struct {
+	cli didiyunClient.EbsClient
+}
+
+var _ didiyunClient.EbsClient = (*tracingEbsClient)(nil)
+
+func newTracingEbsClient(cli didiyunClient.EbsClient) *tracingEbsClient {
+	return &tracingEbsClient{cli: cli}
+}
+
+func (t *tracingEbsClient) Create(ctx context.Context, regionID, zoneID, name, typ string, sizeGB int64) (string, error) {
+	ctx, span := startSpan(ctx, "ebs.Create", attribute.String("ebs.name", name), attribute.String("ebs.zone", zoneID))
+	id, e := t.cli.Create(ctx, regionID, zoneID, name, typ, sizeGB)
+	span.SetAttributes(attribute.String("ebs.uuid", id))
+	endSpan(span, e)
+	return id, e
+}
+
+func (t *tracingEbsClient) Get(ctx context.Context, ebsUUID string) (*compute.EbsInfo, error) {
+	ctx, span := startSpan(ctx, "ebs.Get", attribute.String("ebs.uuid", ebsUUID))
+	info, e := t.cli.Get(ctx, ebsUUID)
+	endSpan(span, e)
+	return info, e
+}
+
+func (t *tracingEbsClient) Delete(ctx context.Context, ebsUUID string) error {
+	ctx, span := startSpan(ctx, "ebs.Delete", attribute.String("ebs.uuid", ebsUUID))
+	e := t.cli.Delete(ctx, ebsUUID)
+	endSpan(span, e)
+	return e
+}
+
+func (t *tracingEbsClient) Attach(ctx context.Context, ebsUUID, dc2Name string) (string, error) {
+	ctx, span := startSpan(ctx, "ebs.Attach", attribute.String("ebs.uuid", ebsUUID), attribute.String("dc2.name", dc2Name))
+	device, e := t.cli.Attach(ctx, ebsUUID, dc2Name)
+	span.SetAttributes(attribute.String("ebs.device", device))
+	endSpan(span, e)
+	return device, e
+}
+
+func (t *tracingEbsClient) Detach(ctx context.Context, ebsUUID string) error {
+	ctx, span := startSpan(ctx, "ebs.Detach", attribute.String("ebs.uuid", ebsUUID))
+	e := t.cli.Detach(ctx, ebsUUID)
+	endSpan(span, e)
+	return e
+}
+
+func (t *tracingEbsClient) Expand(ctx context.Context, ebsUUID string, sizeGB int64) error {
+	ctx, span := startSpan(ctx, "ebs.Expand", attribute.String("ebs.uuid", ebsUUID), attribute.Int64("ebs.size_gb", sizeGB))
+	e := t.cli.Expand(ctx, ebsUUID, sizeGB)
+	endSpan(span, e)
+	return e
+}
+
+// tracingCloudClient starts a span for each didiyun api call not covered by didiyunClient.EbsClient
+type tracingCloudClient struct {
+	cli cloudClient
+}
+
+var _ cloudClient = (*tracingCloudClient)(nil)
+
+func newTracingCloudClient(cli cloudClient) *tracingCloudClient {
+	return &tracingCloudClient{cli: cli}
+}
+
+func (t *tracingCloudClient) ListEbs(ctx context.Context, regionID, zoneID string, start, limit int32) ([]*compute.EbsInfo, error) {
+	ctx, span := startSpan(ctx, "ebs.List", attribute.String("ebs.zone", zoneID), attribute.Int("list.start", int(start)))
+	infos, e := t.cli.ListEbs(ctx, regionID, zoneID, start, limit)
+	endSpan(span, e)
+	return infos, e
+}
+
+func (t *tracingCloudClient) CreateFromSnapshot(ctx context.Context, regionID, zoneID, name, typ, snapUUID string, sizeGB int64) (string, error) {
+	ctx, span := startSpan(ctx, "ebs.CreateFromSnapshot", attribute.String("ebs.name", name), attribute.String("snapshot.uuid", snapUUID))
+	id, e := t.cli.CreateFromSnapshot(ctx, regionID, zoneID, name, typ, snapUUID, sizeGB)
+	span.SetAttributes(attribute.String("ebs.uuid", id))
+	endSpan(span, e)
+	return id, e
+}
+
+func (t *tracingCloudClient) CreateSnapshot(ctx context.Context, regionID, ebsUUID, name string) (string, error) {
+	ctx, span := startSpan(ctx, "snapshot.Create", attribute.String("ebs.uuid", ebsUUID), attribute.String("snapshot.name", name))
+	id, e := t.cli.CreateSnapshot(ctx, regionID, ebsUUID, name)
+	span.SetAttributes(attribute.String("snapshot.uuid", id))
+	endSpan(span, e)
+	return id, e
+}
+
+func (t *tracingCloudClient) ListSnapshots(ctx context.Context, regionID, ebsUUID, name string, start, limit int32) ([]*compute.SnapInfo, error) {
+	ctx, span := startSpan(ctx, "snapshot.List", attribute.String("ebs.uuid", ebsUUID), attribute.String("snapshot.name", name), attribute.Int("list.start", int(start)))
+	snaps, e := t.cli.ListSnapshots(ctx, regionID, ebsUUID, name, start, limit)
+	endSpan(span, e)
+	return snaps, e
+}
+
+func (t *tracingCloudClient) DeleteSnapshot(ctx context.Context, regionID, snapUUID string) error {
+	ctx, span := startSpan(ctx, "snapshot.Delete", attribute.String("snapshot.uuid", snapUUID))
+	e := t.cli.DeleteSnapshot(ctx, regionID, snapUUID)
+	endSpan(span, e)
+	return e
+}
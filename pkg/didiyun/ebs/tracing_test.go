@@ -0,0 +1,43 @@
+package ebs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didiyunClient "github.com/supremind/didiyun-client/pkg"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+)
+
+func TestTracingInterceptor(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(prev)
+
+	c, e := didiyunClient.NewMock()
+	require.NoError(t, e)
+	ebsCli := newTracingEbsClient(c.Ebs())
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	_, e = tracingInterceptor(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1"}, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, e := ebsCli.Get(ctx, "vol-1")
+			return nil, toStatus(e)
+		})
+	require.Error(t, e)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 2)
+	get, rpc := spans[0], spans[1]
+	assert.Equal(t, "ebs.Get", get.Name())
+	assert.Equal(t, otelcodes.Error, get.Status().Code, "not found error is recorded")
+	assert.Equal(t, info.FullMethod, rpc.Name())
+	assert.Equal(t, rpc.SpanContext().SpanID(), get.Parent().SpanID(), "ebs calls are children of the rpc")
+	assert.Equal(t, otelcodes.Error, rpc.Status().Code)
+}
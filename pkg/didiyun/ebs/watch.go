@@ -0,0 +1,47 @@
+package ebs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog"
+)
+
+// watchFile calls onChange with the new content when the file changes, until ctx is done
+func watchFile(ctx context.Context, path string, onChange func(data []byte)) error {
+	watcher, e := fsnotify.NewWatcher()
+	if e != nil {
+		return fmt.Errorf("watch file %s error %w", path, e)
+	}
+	// watch the directory instead of the file, files of mounted config maps and secrets are replaced by renaming symlinks
+	if e := watcher.Add(filepath.Dir(path)); e != nil {
+		watcher.Close()
+		return fmt.Errorf("watch file %s error %w", path, e)
+	}
+
+	last, _ := os.ReadFile(path)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-watcher.Errors:
+				klog.Errorf("watch file %s error: %s", path, e)
+			case <-watcher.Events:
+				data, e := os.ReadFile(path)
+				// empty if the file is truncated before written
+				if e != nil || len(data) == 0 || bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				onChange(data)
+			}
+		}
+	}()
+	return nil
+}